@@ -1,18 +1,35 @@
 package api
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fuglesteg/timid/docker"
+	"github.com/fuglesteg/timid/eventLog"
+	"github.com/fuglesteg/timid/history"
+	"github.com/fuglesteg/timid/policy"
 	"github.com/fuglesteg/timid/proxy"
-	"github.com/fuglesteg/timid/verboseLog"
+	"github.com/fuglesteg/timid/logging"
 )
 
+var logger = logging.For(logging.Api)
+
 type Api struct {
 	ProxyServer *proxy.Proxy
 	ContainerGroup *docker.ContainerGroup
+	History *history.Store
+	Policy *policy.Store
+	// Required as a bearer token by requests changing state, unset disables it
+	Token string
+	operations *operations
 }
 
 type ContainerState string
@@ -21,6 +38,8 @@ const (
 	Stopped ContainerState = "Stopped"
 	Paused = "Paused"
 	Running = "Running"
+	// No containers of the group have been found yet
+	Unavailable = "Unavailable"
 )
 
 type Container struct {
@@ -34,18 +53,137 @@ type ContainerGroup struct {
 	State ContainerState `json:"state"`
 }
 
+type Docker struct {
+	Reachable bool `json:"reachable"`
+	Error string `json:"error,omitempty"`
+}
+
+type Check struct {
+	Name string `json:"name"`
+	Ok bool `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type Health struct {
+	Status string `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+type PacketTrace struct {
+	Mode string `json:"mode"`
+	SampleRate float64 `json:"sampleRate"`
+	Clients []string `json:"clients"`
+	MaxBytes int `json:"maxBytes"`
+	// How long tracing stays enabled, only in requests
+	Duration string `json:"duration,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+type CaptureRequest struct {
+	Duration string `json:"duration"`
+	Client string `json:"client"`
+}
+
+type Capture struct {
+	File string `json:"file"`
+	Client string `json:"client,omitempty"`
+	Started time.Time `json:"started"`
+	Until time.Time `json:"until"`
+	Packets uint64 `json:"packets"`
+	Running bool `json:"running"`
+	Error string `json:"error,omitempty"`
+}
+
+type ClientUsage struct {
+	Client string `json:"client"`
+	Sessions int `json:"sessions"`
+	ConnectedSeconds float64 `json:"connectedSeconds"`
+	Bytes uint64 `json:"bytes"`
+}
+
+type Usage struct {
+	Date string `json:"date"`
+	Group string `json:"group"`
+	RuntimeSeconds float64 `json:"runtimeSeconds"`
+	PausedSeconds float64 `json:"pausedSeconds"`
+	Wakes int `json:"wakes"`
+	UniqueClients int `json:"uniqueClients"`
+	Bytes uint64 `json:"bytes"`
+	Clients []ClientUsage `json:"clients"`
+}
+
+type Policy struct {
+	ContainerShutdownDelay string `json:"containerShutdownDelay"`
+	PauseContainer bool `json:"pauseContainer"`
+	PauseDuration string `json:"pauseDuration"`
+	ConnectionTimeoutDelay string `json:"connectionTimeoutDelay"`
+	HoldAwakeUntil *time.Time `json:"holdAwakeUntil"`
+	HoldAwakeReason string `json:"holdAwakeReason,omitempty"`
+}
+
+// Omitted fields are left as they are
+type PolicyPatch struct {
+	ContainerShutdownDelay *string `json:"containerShutdownDelay"`
+	PauseContainer *bool `json:"pauseContainer"`
+	PauseDuration *string `json:"pauseDuration"`
+	ConnectionTimeoutDelay *string `json:"connectionTimeoutDelay"`
+	// RFC 3339 time, an empty string removes the hold
+	HoldAwakeUntil *string `json:"holdAwakeUntil"`
+	// Duration string, alternative to holdAwakeUntil
+	HoldAwakeFor *string `json:"holdAwakeFor"`
+	HoldAwakeReason *string `json:"holdAwakeReason"`
+}
+
 type Info struct {
 	Connections int `json:"connections"`
 	ContainerGroup ContainerGroup `json:"containerGroup"`
+	Docker Docker `json:"docker"`
+	AuthRequired bool `json:"authRequired"`
+}
+
+type Connection struct {
+	ClientAddress string `json:"clientAddress"`
+	Created time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	PacketsFromClient uint64 `json:"packetsFromClient"`
+	BytesFromClient uint64 `json:"bytesFromClient"`
+	PacketsFromServer uint64 `json:"packetsFromServer"`
+	BytesFromServer uint64 `json:"bytesFromServer"`
+}
+
+type BanRequest struct {
+	Address string `json:"address"`
+	Duration string `json:"duration"`
+	Reason string `json:"reason"`
+}
+
+type Ban struct {
+	Address string `json:"address"`
+	Reason string `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires *time.Time `json:"expires"`
+}
+
+type Rejected struct {
+	Banned uint64 `json:"banned"`
+	Denied uint64 `json:"denied"`
+	PacketLimit uint64 `json:"packetLimit"`
+	ByteLimit uint64 `json:"byteLimit"`
+	SessionLimit uint64 `json:"sessionLimit"`
+	Bytes uint64 `json:"bytes"`
 }
 
 type Proxy struct {
 	Connections int `json:"connections"`
 	Port int `json:"port"`
 	TargetAddress string `json:"targetAddress"`
+	Rejected Rejected `json:"rejected"`
 }
 
 func (api Api) getContainerGroupState() ContainerState {
+	if !api.ContainerGroup.Discovered() {
+		return Unavailable
+	}
 	isPaused := api.ContainerGroup.AllContainersArePaused()
 	if isPaused {
 		return Paused
@@ -78,20 +216,261 @@ func (api Api) mapContainerToContainerDTO(container docker.Container) Container
 	}
 }
 
+func mapBanToBanDTO(ban proxy.Ban) Ban {
+	return Ban {
+		Address: ban.Address,
+		Reason: ban.Reason,
+		Created: ban.Created,
+		Expires: ban.Expires,
+	}
+}
+
+func mapPacketTraceToPacketTraceDTO(trace proxy.PacketTrace) PacketTrace {
+	traceDTO := PacketTrace {
+		Mode: trace.Mode,
+		SampleRate: trace.SampleRate,
+		Clients: trace.Clients,
+		MaxBytes: trace.MaxBytes,
+	}
+	if !trace.Until.IsZero() {
+		traceDTO.Until = &trace.Until
+	}
+	return traceDTO
+}
+
+func mapUsageToUsageDTO(usage history.Usage) Usage {
+	clients := []ClientUsage{}
+	for _, client := range usage.Clients {
+		clients = append(clients, ClientUsage {
+			Client: client.Client,
+			Sessions: client.Sessions,
+			ConnectedSeconds: client.Connected.Seconds(),
+			Bytes: client.Bytes,
+		})
+	}
+	return Usage {
+		Date: usage.Date,
+		Group: usage.Group,
+		RuntimeSeconds: usage.Runtime.Seconds(),
+		PausedSeconds: usage.Paused.Seconds(),
+		Wakes: usage.Wakes,
+		UniqueClients: len(usage.Clients),
+		Bytes: usage.Bytes,
+		Clients: clients,
+	}
+}
+
+// One row per group and day, or per client of a group and day if byClient
+func writeUsageCsvToResponse(w http.ResponseWriter, usages []Usage, byClient bool) {
+	w.Header().Set("Content-Type", "text/csv")
+	writer := csv.NewWriter(w)
+	formatSeconds := func(seconds float64) string {
+		return strconv.FormatFloat(seconds, 'f', 0, 64)
+	}
+	if byClient {
+		writer.Write([]string{"date", "group", "client", "sessions", "connectedSeconds", "bytes"})
+		for _, usage := range usages {
+			for _, client := range usage.Clients {
+				writer.Write([]string{usage.Date, usage.Group, client.Client, strconv.Itoa(client.Sessions),
+					formatSeconds(client.ConnectedSeconds), strconv.FormatUint(client.Bytes, 10)})
+			}
+		}
+	} else {
+		writer.Write([]string{"date", "group", "runtimeSeconds", "pausedSeconds", "wakes", "uniqueClients", "bytes"})
+		for _, usage := range usages {
+			writer.Write([]string{usage.Date, usage.Group, formatSeconds(usage.RuntimeSeconds),
+				formatSeconds(usage.PausedSeconds), strconv.Itoa(usage.Wakes), strconv.Itoa(usage.UniqueClients),
+				strconv.FormatUint(usage.Bytes, 10)})
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		logger.Warn("Failed to write usage report", logging.Err(err))
+	}
+}
+
+func mapPolicyToPolicyDTO(policy policy.Policy) Policy {
+	policyDTO := Policy {
+		ContainerShutdownDelay: policy.ContainerShutdownDelay.String(),
+		PauseContainer: policy.PauseContainer,
+		PauseDuration: policy.PauseDuration.String(),
+		ConnectionTimeoutDelay: policy.ConnectionTimeoutDelay.String(),
+		HoldAwakeReason: policy.HoldAwakeReason,
+	}
+	if !policy.HoldAwakeUntil.IsZero() {
+		policyDTO.HoldAwakeUntil = &policy.HoldAwakeUntil
+	}
+	return policyDTO
+}
+
+func mapPolicyPatchDTOToPolicyPatch(patchDTO PolicyPatch) (policy.Patch, error) {
+	var patch policy.Patch
+	var err error
+	parseDuration := func(value *string) *time.Duration {
+		if value == nil || err != nil {
+			return nil
+		}
+		var duration time.Duration
+		duration, err = time.ParseDuration(*value)
+		return &duration
+	}
+	patch.ContainerShutdownDelay = parseDuration(patchDTO.ContainerShutdownDelay)
+	patch.PauseContainer = patchDTO.PauseContainer
+	patch.PauseDuration = parseDuration(patchDTO.PauseDuration)
+	patch.ConnectionTimeoutDelay = parseDuration(patchDTO.ConnectionTimeoutDelay)
+	patch.HoldAwakeReason = patchDTO.HoldAwakeReason
+	if err != nil {
+		return patch, err
+	}
+	switch {
+	case patchDTO.HoldAwakeUntil != nil && patchDTO.HoldAwakeFor != nil:
+		return patch, errors.New("Only one of holdAwakeUntil and holdAwakeFor can be given")
+	case patchDTO.HoldAwakeUntil != nil && *patchDTO.HoldAwakeUntil == "":
+		patch.HoldAwakeUntil = &time.Time{}
+	case patchDTO.HoldAwakeUntil != nil:
+		until, err := time.Parse(time.RFC3339, *patchDTO.HoldAwakeUntil)
+		if err != nil {
+			return patch, err
+		}
+		patch.HoldAwakeUntil = &until
+	case patchDTO.HoldAwakeFor != nil:
+		duration := parseDuration(patchDTO.HoldAwakeFor)
+		if err != nil {
+			return patch, err
+		}
+		until := time.Now().Add(*duration)
+		patch.HoldAwakeUntil = &until
+	}
+	return patch, nil
+}
+
+func mapCaptureToCaptureDTO(capture proxy.CaptureInfo) Capture {
+	return Capture {
+		File: capture.File,
+		Client: capture.Client,
+		Started: capture.Started,
+		Until: capture.Until,
+		Packets: capture.Packets,
+		Running: capture.Running,
+		Error: capture.Error,
+	}
+}
+
+// Respond with the error if there is one, otherwise with an empty 200
+func writeResultToResponse(w http.ResponseWriter, err error) {
+	if err != nil {
+		logger.Warn("Request failed", logging.Err(err))
+		writeErrorToResponse(w, err)
+	}
+}
+
 func writeJsonToResponse(w http.ResponseWriter, value any) {
 	bytes, err := json.Marshal(value);
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		verboseLog.Checkreport(2, err)
+		logger.Warn("Failed to encode response", logging.Err(err))
 		return
 	}
 
+	// Has no effect if the status was already written, those callers set it
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(bytes)
 }
 
+// The proxy loop wakes up every second, so it has stalled if it hasn't made
+// progress for this long
+const proxyLoopStallTimeout = 10 * time.Second
+
+func newCheck(name string, err error) Check {
+	check := Check { Name: name, Ok: err == nil }
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// Respond with the checks, 503 if any of them failed
+func writeHealthToResponse(w http.ResponseWriter, checks []Check) {
+	health := Health { Status: "ok", Checks: checks }
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.Ok {
+			health.Status = "failing"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJsonToResponse(w, health)
+}
+
+// Liveness, whether the proxy loop is making progress
+func (api Api) liveness() []Check {
+	var err error
+	lastLoop := api.ProxyServer.LastLoop()
+	if time.Since(lastLoop) > proxyLoopStallTimeout {
+		err = fmt.Errorf("Proxy loop has not made progress since %s", lastLoop.Format(time.RFC3339))
+	}
+	return []Check { newCheck("proxyLoop", err) }
+}
+
+// Readiness, whether the proxy is listening and the group can be managed
+func (api Api) readiness() []Check {
+	var err error
+	if !api.ProxyServer.Listening() {
+		err = fmt.Errorf("Proxy is not listening on port %d", api.ProxyServer.GetPort())
+	}
+	checks := []Check { newCheck("proxyListener", err) }
+	if !api.ContainerGroup.DockerEnabled() {
+		return checks
+	}
+	_, err = api.ContainerGroup.DockerReachable()
+	checks = append(checks, newCheck("docker", err))
+	err = nil
+	if !api.ContainerGroup.Discovered() {
+		err = docker.ErrGroupNotDiscovered
+	}
+	return append(checks, newCheck("containerGroup", err))
+}
+
+// Date or RFC 3339 time of a query parameter, the zero time if empty
+func parseTimeParameter(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return history.ParseTime(value)
+}
+
 func (api Api) Init(port int) {
-	verboseLog.Vlogf(2, "Starting REST API")
-	mux := http.NewServeMux()
+	logger.Debug("Starting REST API", "port", port)
+	handler := api.handler()
+	go func() {
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", port), handler); err != nil {
+			panic(fmt.Errorf("Failed to initialize REST API: %s", err))
+		}
+	}()
+}
+
+// Every route of the API behind the token check
+func (api Api) handler() http.Handler {
+	mux := api.routes()
+	for _, mismatch := range mux.openApiMismatches() {
+		logger.Warn("Route and OpenAPI document don't match", "mismatch", mismatch)
+	}
+	return api.authenticate(mux)
+}
+
+func (api Api) routes() *router {
+	mux := newRouter()
+	api.operations = newOperations()
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthToResponse(w, api.liveness())
+	})
+
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthToResponse(w, api.readiness())
+	})
 
 	mux.HandleFunc("GET /info", func(w http.ResponseWriter, r *http.Request) {
 		info := Info {
@@ -100,31 +479,323 @@ func (api Api) Init(port int) {
 				Name: api.ContainerGroup.Name,
 				State: api.getContainerGroupState(),
 			},
+			AuthRequired: api.Token != "",
+		}
+		reachable, err := api.ContainerGroup.DockerReachable()
+		info.Docker.Reachable = reachable
+		if err != nil {
+			info.Docker.Error = err.Error()
 		}
 
 		writeJsonToResponse(w, info);
 	})
 
 	mux.HandleFunc("POST /proxy/trigger", func(w http.ResponseWriter, r *http.Request) {
-		api.ProxyServer.OnNewConnection <- 1
+		api.ProxyServer.NotifyNewConnection()
 	})
 
 	mux.HandleFunc("GET /proxy", func(w http.ResponseWriter, r *http.Request) {
+		rejected := api.ProxyServer.GetRejectedCounters()
 		proxy := Proxy {
 			Connections: api.ProxyServer.GetConnectionsAmount(),
 			Port: api.ProxyServer.GetPort(),
 			TargetAddress: api.ProxyServer.GetTargetAddress(),
+			Rejected: Rejected {
+				Banned: rejected.Banned,
+				Denied: rejected.Denied,
+				PacketLimit: rejected.PacketLimit,
+				ByteLimit: rejected.ByteLimit,
+				SessionLimit: rejected.SessionLimit,
+				Bytes: rejected.Bytes,
+			},
 		}
 
 		writeJsonToResponse(w, proxy)
 	})
 
+	mux.HandleFunc("GET /proxy/connections", func(w http.ResponseWriter, r *http.Request) {
+		connectionDTOs := []Connection{}
+		for _, connection := range api.ProxyServer.GetConnections() {
+			connectionDTOs = append(connectionDTOs, Connection {
+				ClientAddress: connection.ClientAddr,
+				Created: connection.Created,
+				LastUsed: connection.LastUsed,
+				PacketsFromClient: connection.PacketsFromClient,
+				BytesFromClient: connection.BytesFromClient,
+				PacketsFromServer: connection.PacketsFromServer,
+				BytesFromServer: connection.BytesFromServer,
+			})
+		}
+
+		writeJsonToResponse(w, connectionDTOs)
+	})
+
+	mux.HandleFunc("DELETE /proxy/connections/{clientAddress}", func(w http.ResponseWriter, r *http.Request) {
+		clientAddress := r.PathValue("clientAddress")
+		if !api.ProxyServer.KickConnection(clientAddress) {
+			writeNotFound(w, fmt.Sprintf("No connection from %s", clientAddress))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /debug/trace", func(w http.ResponseWriter, r *http.Request) {
+		writeJsonToResponse(w, mapPacketTraceToPacketTraceDTO(api.ProxyServer.GetPacketTrace()))
+	})
+
+	mux.HandleFunc("PUT /debug/trace", func(w http.ResponseWriter, r *http.Request) {
+		var traceRequest PacketTrace
+		if err := json.NewDecoder(r.Body).Decode(&traceRequest); err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		trace := proxy.PacketTrace {
+			Mode: traceRequest.Mode,
+			SampleRate: traceRequest.SampleRate,
+			Clients: traceRequest.Clients,
+			MaxBytes: traceRequest.MaxBytes,
+		}
+		if traceRequest.Duration != "" {
+			duration, err := time.ParseDuration(traceRequest.Duration)
+			if err != nil {
+				writeInvalidRequest(w, err)
+				return
+			}
+			trace.Until = time.Now().Add(duration)
+		}
+		if err := api.ProxyServer.SetPacketTrace(trace); err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		writeJsonToResponse(w, mapPacketTraceToPacketTraceDTO(api.ProxyServer.GetPacketTrace()))
+	})
+
+	mux.HandleFunc("DELETE /debug/trace", func(w http.ResponseWriter, r *http.Request) {
+		api.ProxyServer.SetPacketTrace(proxy.PacketTrace { Mode: proxy.TraceOff })
+	})
+
+	mux.HandleFunc("POST /debug/capture", func(w http.ResponseWriter, r *http.Request) {
+		var captureRequest CaptureRequest
+		if err := json.NewDecoder(r.Body).Decode(&captureRequest); err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		duration, err := time.ParseDuration(captureRequest.Duration)
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		capture, err := api.ProxyServer.StartCapture(duration, captureRequest.Client)
+		if errors.Is(err, proxy.ErrCaptureRunning) {
+			writeErrorToResponse(w, err)
+			return
+		} else if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJsonToResponse(w, mapCaptureToCaptureDTO(capture))
+	})
+
+	mux.HandleFunc("GET /debug/capture", func(w http.ResponseWriter, r *http.Request) {
+		capture, err := api.ProxyServer.GetCapture()
+		if err != nil {
+			writeNotFound(w, err.Error())
+			return
+		}
+		writeJsonToResponse(w, mapCaptureToCaptureDTO(capture))
+	})
+
+	mux.HandleFunc("GET /debug/capture/file", func(w http.ResponseWriter, r *http.Request) {
+		capture, err := api.ProxyServer.GetCapture()
+		if err != nil {
+			writeNotFound(w, err.Error())
+			return
+		}
+		if capture.Running {
+			writeError(w, http.StatusConflict, CodeCaptureRunning, "Capture is still running", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(capture.File)))
+		http.ServeFile(w, r, capture.File)
+	})
+
+	mux.HandleFunc("GET /proxy/bans", func(w http.ResponseWriter, r *http.Request) {
+		banDTOs := []Ban{}
+		for _, ban := range api.ProxyServer.GetBans() {
+			banDTOs = append(banDTOs, mapBanToBanDTO(ban))
+		}
+
+		writeJsonToResponse(w, banDTOs)
+	})
+
+	mux.HandleFunc("POST /proxy/bans", func(w http.ResponseWriter, r *http.Request) {
+		var banRequest BanRequest
+		if err := json.NewDecoder(r.Body).Decode(&banRequest); err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		var duration time.Duration
+		if banRequest.Duration != "" {
+			var err error
+			duration, err = time.ParseDuration(banRequest.Duration)
+			if err != nil {
+				writeInvalidRequest(w, err)
+				return
+			}
+		}
+
+		ban, err := api.ProxyServer.Ban(banRequest.Address, duration, banRequest.Reason)
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJsonToResponse(w, mapBanToBanDTO(ban))
+	})
+
+	mux.HandleFunc("DELETE /proxy/bans/{address}", func(w http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("address")
+		removed, err := api.ProxyServer.Unban(address)
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		if !removed {
+			writeNotFound(w, fmt.Sprintf("%s is not banned", address))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		writeJsonToResponse(w, eventLog.Recent())
+	})
+
+	mux.HandleFunc("GET /events/stream", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		events, unsubscribe := eventLog.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case event := <-events:
+				bytes, err := json.Marshal(event)
+				if err != nil {
+					logger.Warn("Failed to encode event", logging.Err(err))
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, bytes)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from, err := parseTimeParameter(query.Get("from"))
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		to, err := parseTimeParameter(query.Get("to"))
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		kind := query.Get("kind")
+		if err := history.ValidKind(kind); err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		writeJsonToResponse(w, api.History.Query(from, to, kind))
+	})
+
+	mux.HandleFunc("GET /reports/usage", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from, err := parseTimeParameter(query.Get("from"))
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		to, err := parseTimeParameter(query.Get("to"))
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		usageDTOs := []Usage{}
+		for _, usage := range api.History.Usage(from, to) {
+			usageDTOs = append(usageDTOs, mapUsageToUsageDTO(usage))
+		}
+
+		format := query.Get("format")
+		if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = "csv"
+		}
+		switch format {
+		case "", "json":
+			writeJsonToResponse(w, usageDTOs)
+		case "csv":
+			writeUsageCsvToResponse(w, usageDTOs, query.Get("by") == "client")
+		default:
+			writeInvalidRequest(w, fmt.Errorf("Unknown report format: %s", format))
+		}
+	})
+
+	mux.HandleFunc("GET /operations/{operationId}", func(w http.ResponseWriter, r *http.Request) {
+		operationId := r.PathValue("operationId")
+		operation, found := api.operations.get(operationId)
+		if !found {
+			writeNotFound(w, fmt.Sprintf("No operation %s", operationId))
+			return
+		}
+		writeJsonToResponse(w, operation)
+	})
+
+	mux.HandleFunc("GET /policy", func(w http.ResponseWriter, r *http.Request) {
+		writeJsonToResponse(w, mapPolicyToPolicyDTO(api.Policy.Get()))
+	})
+
+	mux.HandleFunc("PATCH /policy", func(w http.ResponseWriter, r *http.Request) {
+		var patchDTO PolicyPatch
+		if err := json.NewDecoder(r.Body).Decode(&patchDTO); err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		patch, err := mapPolicyPatchDTOToPolicyPatch(patchDTO)
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		policy, err := api.Policy.Update(patch, "api "+r.RemoteAddr)
+		if err != nil {
+			writeInvalidRequest(w, err)
+			return
+		}
+		writeJsonToResponse(w, mapPolicyToPolicyDTO(policy))
+	})
+
 	mux.HandleFunc("GET /containers", func(w http.ResponseWriter, r *http.Request) {
 		containers := api.ContainerGroup.GetContainers()
-		var containerDTOs []*Container
+		containerDTOs := []Container{}
 		for _, container := range containers {
-			containerDTO := api.mapContainerToContainerDTO(*container)
-			containerDTOs = append(containerDTOs, &containerDTO)
+			containerDTOs = append(containerDTOs, api.mapContainerToContainerDTO(*container))
 		}
 
 		writeJsonToResponse(w, containerDTOs);
@@ -132,61 +803,67 @@ func (api Api) Init(port int) {
 
 	mux.HandleFunc("GET /containers/{containerId}", func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
-		var containerDTO *Container
 		containers := api.ContainerGroup.GetContainers()
 		for _, container := range containers {
 			if containerId == container.ID {
-				*containerDTO = api.mapContainerToContainerDTO(*container)
+				writeJsonToResponse(w, api.mapContainerToContainerDTO(*container))
+				return
 			}
 		}
 
-		if containerDTO == nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-
-		writeJsonToResponse(w, containerDTO);
+		writeErrorToResponse(w, docker.ErrContainerNotFound)
 	})
 
 	mux.HandleFunc("POST /containers/start", func(w http.ResponseWriter, r *http.Request) {
-		api.ContainerGroup.Start()
+		api.runOperation(w, r, "start", "", api.ContainerGroup.Start)
 	})
 
 	mux.HandleFunc("POST /containers/stop", func(w http.ResponseWriter, r *http.Request) {
-		api.ContainerGroup.Stop()
+		api.runOperation(w, r, "stop", "", api.ContainerGroup.Stop)
 	})
 
 	mux.HandleFunc("POST /containers/pause", func(w http.ResponseWriter, r *http.Request) {
-		api.ContainerGroup.Pause()
+		api.runOperation(w, r, "pause", "", api.ContainerGroup.Pause)
 	})
 
 	mux.HandleFunc("POST /containers/restart", func(w http.ResponseWriter, r *http.Request) {
-		api.ContainerGroup.Restart()
+		api.runOperation(w, r, "restart", "", api.ContainerGroup.Restart)
 	})
 
 	mux.HandleFunc("POST /containers/{containerId}/start", func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
-		api.ContainerGroup.StartContainer(containerId)
+		api.runOperation(w, r, "start", containerId, func(ctx context.Context) error {
+			return api.ContainerGroup.StartContainer(ctx, containerId)
+		})
 	})
 
 	mux.HandleFunc("POST /containers/{containerId}/stop", func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
-		api.ContainerGroup.StopContainer(containerId)
+		api.runOperation(w, r, "stop", containerId, func(ctx context.Context) error {
+			return api.ContainerGroup.StopContainer(ctx, containerId)
+		})
 	})
 
 	mux.HandleFunc("POST /containers/{containerId}/pause", func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
-		api.ContainerGroup.PauseContainer(containerId)
+		api.runOperation(w, r, "pause", containerId, func(ctx context.Context) error {
+			return api.ContainerGroup.PauseContainer(ctx, containerId)
+		})
 	})
 
 	mux.HandleFunc("POST /containers/{containerId}/restart", func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
-		api.ContainerGroup.RestartContainer(containerId)
+		api.runOperation(w, r, "restart", containerId, func(ctx context.Context) error {
+			return api.ContainerGroup.RestartContainer(ctx, containerId)
+		})
 	})
 
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
-			panic(fmt.Errorf("Failed to initialize REST API: %s", err))
-		}
-	}()
+	handleUi(mux)
+
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openApiDocument)
+	})
+
+	return mux
 }
@@ -0,0 +1,503 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fuglesteg/timid/docker"
+	"github.com/fuglesteg/timid/history"
+	"github.com/fuglesteg/timid/policy"
+	"github.com/fuglesteg/timid/proxy"
+)
+
+// The parts of the OpenAPI document the responses are checked against
+type openApiSchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Format     string                    `json:"format"`
+	Nullable   bool                      `json:"nullable"`
+	Enum       []any                     `json:"enum"`
+	Properties map[string]*openApiSchema `json:"properties"`
+	Required   []string                  `json:"required"`
+	Items      *openApiSchema            `json:"items"`
+	Minimum    *float64                  `json:"minimum"`
+	Maximum    *float64                  `json:"maximum"`
+}
+
+type openApiResponse struct {
+	Ref     string                     `json:"$ref"`
+	Headers map[string]json.RawMessage `json:"headers"`
+	Content map[string]struct {
+		Schema *openApiSchema `json:"schema"`
+	} `json:"content"`
+}
+
+type openApiOperation struct {
+	Responses map[string]openApiResponse `json:"responses"`
+}
+
+type openApi struct {
+	Paths      map[string]map[string]openApiOperation `json:"paths"`
+	Components struct {
+		Schemas   map[string]*openApiSchema  `json:"schemas"`
+		Responses map[string]openApiResponse `json:"responses"`
+	} `json:"components"`
+}
+
+func loadOpenApi(t *testing.T) *openApi {
+	t.Helper()
+	var document openApi
+	if err := json.Unmarshal(openApiDocument, &document); err != nil {
+		t.Fatalf("Failed to parse the OpenAPI document: %s", err)
+	}
+	return &document
+}
+
+// The documented response for a status of an operation like "GET /info"
+func (document *openApi) response(operation string, status int) (openApiResponse, error) {
+	method, path, _ := strings.Cut(operation, " ")
+	documented, found := document.Paths[path][strings.ToLower(method)]
+	if !found {
+		return openApiResponse{}, fmt.Errorf("Operation %s is not documented", operation)
+	}
+	response, found := documented.Responses[strconv.Itoa(status)]
+	if !found {
+		return openApiResponse{}, fmt.Errorf("Status %d is not documented for %s", status, operation)
+	}
+	if name, isRef := strings.CutPrefix(response.Ref, "#/components/responses/"); isRef {
+		response, found = document.Components.Responses[name]
+		if !found {
+			return openApiResponse{}, fmt.Errorf("Unknown response %s", response.Ref)
+		}
+	}
+	return response, nil
+}
+
+func (document *openApi) resolve(schema *openApiSchema) (*openApiSchema, error) {
+	for schema.Ref != "" {
+		name, _ := strings.CutPrefix(schema.Ref, "#/components/schemas/")
+		resolved, found := document.Components.Schemas[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown schema %s", schema.Ref)
+		}
+		schema = resolved
+	}
+	return schema, nil
+}
+
+// Check a decoded JSON value against a schema, properties that are not
+// documented are errors so the document can't fall behind the handlers. An
+// object schema without properties allows any
+func (document *openApi) validate(schema *openApiSchema, value any, at string) error {
+	schema, err := document.resolve(schema)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s is null", at)
+	}
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, value) {
+		return fmt.Errorf("%s is %v, not one of %v", at, value, schema.Enum)
+	}
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s is not an object: %v", at, value)
+		}
+		for _, property := range schema.Required {
+			if _, found := object[property]; !found {
+				return fmt.Errorf("%s is missing required property %s", at, property)
+			}
+		}
+		for property, propertyValue := range object {
+			if schema.Properties == nil {
+				break
+			}
+			propertySchema, found := schema.Properties[property]
+			if !found {
+				return fmt.Errorf("%s has undocumented property %s", at, property)
+			}
+			if err := document.validate(propertySchema, propertyValue, at+"."+property); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s is not an array: %v", at, value)
+		}
+		for i, item := range array {
+			if err := document.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s is not a string: %v", at, value)
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, text); err != nil {
+				return fmt.Errorf("%s is not a date-time: %s", at, text)
+			}
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s is not a number: %v", at, value)
+		}
+		if schema.Type == "integer" && number != math.Trunc(number) {
+			return fmt.Errorf("%s is not an integer: %v", at, number)
+		}
+		if schema.Minimum != nil && number < *schema.Minimum {
+			return fmt.Errorf("%s is below the minimum %v: %v", at, *schema.Minimum, number)
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			return fmt.Errorf("%s is above the maximum %v: %v", at, *schema.Maximum, number)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s is not a boolean: %v", at, value)
+		}
+	default:
+		return fmt.Errorf("%s has a schema without a supported type", at)
+	}
+	return nil
+}
+
+// Check the status, headers and body of a response against the document
+func (document *openApi) check(operation string, recorder *httptest.ResponseRecorder) error {
+	documented, err := document.response(operation, recorder.Code)
+	if err != nil {
+		return err
+	}
+	for header := range documented.Headers {
+		if recorder.Header().Get(header) == "" {
+			return fmt.Errorf("Documented header %s is missing", header)
+		}
+	}
+	if len(documented.Content) == 0 {
+		if recorder.Body.Len() > 0 {
+			return fmt.Errorf("Status %d is documented without a body, got %s", recorder.Code, recorder.Body)
+		}
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("Invalid Content-Type: %w", err)
+	}
+	content, found := documented.Content[mediaType]
+	if !found {
+		return fmt.Errorf("Content-Type %s is not documented for status %d", mediaType, recorder.Code)
+	}
+	if mediaType != "application/json" {
+		return nil
+	}
+	var body any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		return fmt.Errorf("Body is not JSON: %w: %s", err, recorder.Body)
+	}
+	return document.validate(content.Schema, body, "body")
+}
+
+const (
+	testContainerId = "c0ffee0000000000000000000000000000000000000000000000000000000000"
+	testToken       = "secret"
+)
+
+// Api on a group with a single container and no Docker controller, so every
+// Docker operation fails without a daemon
+func newTestApi(t *testing.T, group *docker.ContainerGroup) Api {
+	t.Helper()
+	proxyServer, err := proxy.NewProxy(0, "127.0.0.1:9", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer.SetCaptureDir(t.TempDir())
+	historyStore, err := history.Open(filepath.Join(t.TempDir(), "history.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyStore, err := policy.NewStore(policy.Policy{
+		ContainerShutdownDelay: time.Minute,
+		ConnectionTimeoutDelay: time.Minute,
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Api{
+		ProxyServer:    proxyServer,
+		ContainerGroup: group,
+		History:        historyStore,
+		Policy:         policyStore,
+	}
+}
+
+func newTestGroup() *docker.ContainerGroup {
+	return docker.NewContainerGroup("test", []*docker.Container{{Name: "/game", ID: testContainerId}}, nil)
+}
+
+type contractCase struct {
+	operation string // Documented operation, like "GET /containers/{containerId}"
+	path      string // Requested path, the path of the operation if empty
+	// Requested path known only once earlier cases ran, overrides path
+	pathFrom *string
+	body     string
+	token    string
+	status   int
+	// Run before the request
+	before func(t *testing.T)
+	// Run with the response once it matched the document
+	after func(t *testing.T, recorder *httptest.ResponseRecorder)
+}
+
+func (test contractCase) name() string {
+	if test.path == "" {
+		return fmt.Sprintf("%s %d", test.operation, test.status)
+	}
+	method, _, _ := strings.Cut(test.operation, " ")
+	return fmt.Sprintf("%s %s %d", method, test.path, test.status)
+}
+
+func (test contractCase) run(t *testing.T, document *openApi, handler http.Handler) {
+	if test.before != nil {
+		test.before(t)
+	}
+	method, path, _ := strings.Cut(test.operation, " ")
+	if test.path != "" {
+		path = test.path
+	}
+	if test.pathFrom != nil {
+		path = *test.pathFrom
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	request := httptest.NewRequest(method, path, strings.NewReader(test.body)).WithContext(ctx)
+	if test.token != "" {
+		request.Header.Set("Authorization", "Bearer "+test.token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != test.status {
+		t.Fatalf("Got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+	}
+	if err := document.check(test.operation, recorder); err != nil {
+		t.Fatal(err)
+	}
+	if test.after != nil {
+		test.after(t, recorder)
+	}
+}
+
+// Poll an operation started with ?async=true until it finished, so the next
+// one doesn't conflict with it
+func waitForOperation(handler http.Handler) func(t *testing.T, recorder *httptest.ResponseRecorder) {
+	return func(t *testing.T, recorder *httptest.ResponseRecorder) {
+		location := recorder.Header().Get("Location")
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			poll := httptest.NewRecorder()
+			handler.ServeHTTP(poll, httptest.NewRequest(http.MethodGet, location, nil))
+			var operation Operation
+			if err := json.Unmarshal(poll.Body.Bytes(), &operation); err != nil {
+				t.Fatal(err)
+			}
+			if operation.Status != OperationRunning {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Operation %s did not finish", location)
+	}
+}
+
+func TestRoutesMatchOpenApiDocument(t *testing.T) {
+	api := newTestApi(t, newTestGroup())
+	for _, mismatch := range api.routes().openApiMismatches() {
+		t.Error(mismatch)
+	}
+}
+
+func TestResponsesMatchOpenApiDocument(t *testing.T) {
+	document := loadOpenApi(t)
+	api := newTestApi(t, newTestGroup())
+	handler := api.handler()
+	var operationLocation string
+	rememberOperation := func(t *testing.T, recorder *httptest.ResponseRecorder) {
+		operationLocation = recorder.Header().Get("Location")
+		waitForOperation(handler)(t, recorder)
+	}
+
+	tests := []contractCase{
+		{operation: "GET /healthz", status: http.StatusOK},
+		// Without Docker only the proxy listener is checked
+		{operation: "GET /readyz", status: http.StatusOK},
+		{operation: "GET /info", status: http.StatusOK},
+		{operation: "GET /openapi.json", status: http.StatusOK},
+		{operation: "GET /ui", status: http.StatusMovedPermanently},
+		{operation: "GET /ui/", status: http.StatusOK},
+
+		{operation: "POST /proxy/trigger", status: http.StatusOK},
+		{operation: "GET /proxy", status: http.StatusOK},
+		{operation: "GET /proxy/connections", status: http.StatusOK},
+		{operation: "DELETE /proxy/connections/{clientAddress}", path: "/proxy/connections/192.0.2.1:50000",
+			status: http.StatusNotFound},
+		{operation: "POST /proxy/bans", body: `{"address": "192.0.2.1", "duration": "1h", "reason": "test"}`,
+			status: http.StatusCreated},
+		{operation: "POST /proxy/bans", body: `{"address": "not an address"}`, status: http.StatusBadRequest},
+		{operation: "GET /proxy/bans", status: http.StatusOK},
+		{operation: "DELETE /proxy/bans/{address}", path: "/proxy/bans/192.0.2.1", status: http.StatusNoContent},
+		{operation: "DELETE /proxy/bans/{address}", path: "/proxy/bans/192.0.2.1", status: http.StatusNotFound},
+		{operation: "DELETE /proxy/bans/{address}", path: "/proxy/bans/nope", status: http.StatusBadRequest},
+
+		{operation: "PUT /debug/trace", body: `{"mode": "length", "sampleRate": 0.5, "duration": "1m"}`,
+			status: http.StatusOK},
+		{operation: "PUT /debug/trace", body: `{"mode": "everything"}`, status: http.StatusBadRequest},
+		{operation: "GET /debug/trace", status: http.StatusOK},
+		{operation: "DELETE /debug/trace", status: http.StatusOK},
+		{operation: "GET /debug/capture", status: http.StatusNotFound},
+		{operation: "GET /debug/capture/file", status: http.StatusNotFound},
+		{operation: "POST /debug/capture", body: `{"duration": "nope"}`, status: http.StatusBadRequest},
+		{operation: "POST /debug/capture", body: `{"duration": "200ms"}`, status: http.StatusCreated},
+		{operation: "POST /debug/capture", body: `{"duration": "200ms"}`, status: http.StatusConflict},
+		{operation: "GET /debug/capture", status: http.StatusOK},
+		{operation: "GET /debug/capture/file", status: http.StatusConflict},
+		{operation: "GET /debug/capture/file", status: http.StatusOK,
+			before: func(t *testing.T) { time.Sleep(300 * time.Millisecond) }},
+
+		{operation: "GET /events", status: http.StatusOK},
+		{operation: "GET /events/stream", status: http.StatusOK},
+		{operation: "GET /history", path: "/history?kind=event", status: http.StatusOK},
+		{operation: "GET /history", path: "/history?from=yesterday", status: http.StatusBadRequest},
+		{operation: "GET /reports/usage", status: http.StatusOK},
+		{operation: "GET /reports/usage", path: "/reports/usage?by=client&format=csv", status: http.StatusOK},
+		{operation: "GET /reports/usage", path: "/reports/usage?format=xml", status: http.StatusBadRequest},
+
+		{operation: "GET /policy", status: http.StatusOK},
+		{operation: "PATCH /policy", body: `{"pauseContainer": true, "holdAwakeFor": "1h", "holdAwakeReason": "test"}`,
+			status: http.StatusOK},
+		{operation: "PATCH /policy", body: `{"holdAwakeUntil": ""}`, status: http.StatusOK},
+		{operation: "PATCH /policy", body: `{"containerShutdownDelay": "-1m"}`, status: http.StatusBadRequest},
+
+		{operation: "GET /containers", status: http.StatusOK},
+		{operation: "GET /containers/{containerId}", path: "/containers/" + testContainerId, status: http.StatusOK},
+		// Used to dereference a nil *Container instead of responding
+		{operation: "GET /containers/{containerId}", path: "/containers/unknown", status: http.StatusNotFound},
+
+		// Without a Docker controller every action fails like a failing daemon
+		{operation: "POST /containers/start", status: http.StatusBadGateway},
+		{operation: "POST /containers/stop", status: http.StatusBadGateway},
+		{operation: "POST /containers/pause", status: http.StatusBadGateway},
+		{operation: "POST /containers/restart", status: http.StatusBadGateway},
+		{operation: "POST /containers/start", path: "/containers/start?async=maybe", status: http.StatusBadRequest},
+		{operation: "POST /containers/start", path: "/containers/start?async=true", status: http.StatusAccepted,
+			after: rememberOperation},
+		{operation: "GET /operations/{operationId}", pathFrom: &operationLocation, status: http.StatusOK},
+		{operation: "GET /operations/{operationId}", path: "/operations/unknown", status: http.StatusNotFound},
+		{operation: "POST /containers/{containerId}/start", path: "/containers/" + testContainerId + "/start",
+			status: http.StatusBadGateway},
+		{operation: "POST /containers/{containerId}/stop", path: "/containers/" + testContainerId + "/stop",
+			status: http.StatusBadGateway},
+		{operation: "POST /containers/{containerId}/pause", path: "/containers/" + testContainerId + "/pause",
+			status: http.StatusBadGateway},
+		{operation: "POST /containers/{containerId}/restart", path: "/containers/" + testContainerId + "/restart",
+			status: http.StatusBadGateway},
+		{operation: "POST /containers/{containerId}/restart",
+			path: "/containers/" + testContainerId + "/restart?async=true", status: http.StatusAccepted,
+			after: waitForOperation(handler)},
+		{operation: "POST /containers/{containerId}/stop", path: "/containers/unknown/stop", status: http.StatusNotFound},
+	}
+
+	tested := make(map[string]bool)
+	for _, test := range tests {
+		tested[test.operation] = true
+		t.Run(test.name(), func(t *testing.T) {
+			test.run(t, document, handler)
+		})
+	}
+
+	for path, operations := range document.Paths {
+		for method := range operations {
+			operation := strings.ToUpper(method) + " " + path
+			if !tested[operation] {
+				t.Errorf("No test for %s", operation)
+			}
+		}
+	}
+}
+
+// All routes but the health checks, the dashboard page and the document are
+// documented with a 401 when a token is set
+func TestUnauthorizedMatchesOpenApiDocument(t *testing.T) {
+	document := loadOpenApi(t)
+	api := newTestApi(t, newTestGroup())
+	api.Token = testToken
+	handler := api.handler()
+	for _, test := range []contractCase{
+		{operation: "POST /proxy/trigger", status: http.StatusUnauthorized},
+		{operation: "POST /proxy/trigger", token: "wrong", status: http.StatusUnauthorized},
+		{operation: "POST /proxy/trigger", token: testToken, status: http.StatusOK},
+		{operation: "PATCH /policy", body: `{}`, status: http.StatusUnauthorized},
+		{operation: "POST /containers/stop", status: http.StatusUnauthorized},
+		// Captures hold raw payloads and connections client addresses
+		{operation: "GET /debug/capture/file", status: http.StatusUnauthorized},
+		{operation: "GET /debug/capture/file", token: testToken, status: http.StatusNotFound},
+		{operation: "GET /proxy/connections", status: http.StatusUnauthorized},
+		{operation: "GET /history", status: http.StatusUnauthorized},
+		{operation: "GET /reports/usage", status: http.StatusUnauthorized},
+		{operation: "GET /events/stream", status: http.StatusUnauthorized},
+		{operation: "GET /policy", status: http.StatusUnauthorized},
+		{operation: "GET /policy", token: testToken, status: http.StatusOK},
+		// Open without the token
+		{operation: "GET /healthz", status: http.StatusOK},
+		{operation: "GET /readyz", status: http.StatusOK},
+		{operation: "GET /openapi.json", status: http.StatusOK},
+		{operation: "GET /ui", status: http.StatusMovedPermanently},
+		{operation: "GET /ui/", status: http.StatusOK},
+	} {
+		t.Run(test.name(), func(t *testing.T) {
+			test.run(t, document, handler)
+		})
+	}
+}
+
+// Until the containers of the group are found, actions on the group fail
+// with 503
+func TestUndiscoveredGroupMatchesOpenApiDocument(t *testing.T) {
+	document := loadOpenApi(t)
+	api := newTestApi(t, docker.NewContainerGroup("test", nil, nil))
+	handler := api.handler()
+	for _, test := range []contractCase{
+		{operation: "GET /info", status: http.StatusOK,
+			after: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var info Info
+				json.Unmarshal(recorder.Body.Bytes(), &info)
+				if info.ContainerGroup.State != Unavailable {
+					t.Errorf("Group state %s, want %s", info.ContainerGroup.State, Unavailable)
+				}
+			}},
+		{operation: "GET /containers", status: http.StatusOK},
+		{operation: "POST /containers/start", status: http.StatusServiceUnavailable},
+		{operation: "POST /containers/stop", path: "/containers/stop?async=true", status: http.StatusServiceUnavailable},
+		{operation: "POST /containers/{containerId}/start", path: "/containers/" + testContainerId + "/start",
+			status: http.StatusNotFound},
+	} {
+		t.Run(test.name(), func(t *testing.T) {
+			test.run(t, document, handler)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Whether a request may be made without the token, health checks, the
+// dashboard page and the OpenAPI document don't reveal anything about clients
+// or the group
+func publicRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	path := r.URL.Path
+	return path == "/healthz" || path == "/readyz" || path == "/openapi.json" ||
+		path == "/ui" || strings.HasPrefix(path, "/ui/")
+}
+
+// All requests but public ones need the token as a bearer token if one is
+// configured, reading state reveals client addresses and captured payloads
+func (api Api) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.Token == "" || publicRequest(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(api.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid API token", nil)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/fuglesteg/timid/docker"
+	"github.com/fuglesteg/timid/proxy"
+)
+
+// Machine readable codes of failed requests
+const (
+	CodeInvalidRequest      = "invalid_request"
+	CodeUnauthorized        = "unauthorized"
+	CodeNotFound            = "not_found"
+	CodeContainerNotFound   = "container_not_found"
+	CodeConflict            = "conflict"
+	CodeOperationInProgress = "operation_in_progress"
+	CodeCaptureRunning      = "capture_running"
+	CodeDockerFailed        = "docker_failed"
+	CodeGroupUnavailable    = "group_unavailable"
+	CodeInternal            = "internal"
+)
+
+type ContainerError struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Error string `json:"error"`
+}
+
+type ErrorDetails struct {
+	// Containers Docker failed to act on
+	Containers []ContainerError `json:"containers,omitempty"`
+	// Operation that has to finish first
+	OperationId string `json:"operationId,omitempty"`
+}
+
+// Body of every failed request
+type Error struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	Details *ErrorDetails `json:"details,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string, details *ErrorDetails) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJsonToResponse(w, Error { Code: code, Message: message, Details: details })
+}
+
+// The request could not be parsed or had invalid values
+func writeInvalidRequest(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error(), nil)
+}
+
+func writeNotFound(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusNotFound, CodeNotFound, message, nil)
+}
+
+func mapGroupErrorToErrorDetails(groupErr *docker.GroupError) *ErrorDetails {
+	details := &ErrorDetails{}
+	for _, containerErr := range groupErr.Errors {
+		details.Containers = append(details.Containers, ContainerError {
+			Id: containerErr.Container.ID,
+			Name: containerErr.Container.Name,
+			Error: containerErr.Err.Error(),
+		})
+	}
+	return details
+}
+
+// Status and body for an error, 404 if the container is not in the group,
+// 409 if the operation conflicts with a running one or the state of the
+// containers, 503 if the group has not been discovered yet and 502 if Docker
+// failed
+func mapErrorToErrorDTO(err error) (int, Error) {
+	var groupErr *docker.GroupError
+	var inProgressErr *operationInProgressError
+	errorDTO := Error { Message: err.Error() }
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, docker.ErrContainerNotFound):
+		status, errorDTO.Code = http.StatusNotFound, CodeContainerNotFound
+	case errors.Is(err, docker.ErrGroupNotDiscovered):
+		status, errorDTO.Code = http.StatusServiceUnavailable, CodeGroupUnavailable
+	case errors.Is(err, proxy.ErrCaptureRunning):
+		status, errorDTO.Code = http.StatusConflict, CodeCaptureRunning
+	case errors.As(err, &inProgressErr):
+		status, errorDTO.Code = http.StatusConflict, CodeOperationInProgress
+		errorDTO.Details = &ErrorDetails { OperationId: inProgressErr.id }
+	case errors.As(err, &groupErr) && groupErr.Conflict():
+		status, errorDTO.Code = http.StatusConflict, CodeConflict
+		errorDTO.Details = mapGroupErrorToErrorDetails(groupErr)
+	case errors.As(err, &groupErr):
+		status, errorDTO.Code = http.StatusBadGateway, CodeDockerFailed
+		errorDTO.Details = mapGroupErrorToErrorDetails(groupErr)
+	default:
+		errorDTO.Code = CodeInternal
+	}
+	return status, errorDTO
+}
+
+func writeErrorToResponse(w http.ResponseWriter, err error) {
+	status, errorDTO := mapErrorToErrorDTO(err)
+	writeError(w, status, errorDTO.Code, errorDTO.Message, errorDTO.Details)
+}
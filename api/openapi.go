@@ -0,0 +1,67 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// OpenAPI 3 document describing every route, keep it in sync with routes
+//
+//go:embed openapi.json
+var openApiDocument []byte
+
+// ServeMux remembering the patterns routes are registered with
+type router struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func newRouter() *router {
+	return &router{ServeMux: http.NewServeMux()}
+}
+
+func (router *router) Handle(pattern string, handler http.Handler) {
+	router.patterns = append(router.patterns, pattern)
+	router.ServeMux.Handle(pattern, handler)
+}
+
+func (router *router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	router.patterns = append(router.patterns, pattern)
+	router.ServeMux.HandleFunc(pattern, handler)
+}
+
+// Routes missing from the document and documented operations without a
+// route, so a route added without documenting it shows up on the first run
+func (router *router) openApiMismatches() []string {
+	var document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openApiDocument, &document); err != nil {
+		return []string{fmt.Sprintf("Failed to parse the OpenAPI document: %s", err)}
+	}
+	documented := make(map[string]bool)
+	for path, operations := range document.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = false
+		}
+	}
+	var mismatches []string
+	for _, pattern := range router.patterns {
+		if _, found := documented[pattern]; !found {
+			mismatches = append(mismatches, fmt.Sprintf("Route %s is missing from the OpenAPI document", pattern))
+			continue
+		}
+		documented[pattern] = true
+	}
+	for operation, routed := range documented {
+		if !routed {
+			mismatches = append(mismatches, fmt.Sprintf("OpenAPI document has operation %s without a route", operation))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuglesteg/timid/docker"
+	"github.com/fuglesteg/timid/eventLog"
+	"github.com/fuglesteg/timid/logging"
+)
+
+// Amount of finished operations kept for GET /operations/{id}
+const operationHistorySize = 100
+
+const (
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+)
+
+type Operation struct {
+	Id string `json:"id"`
+	Action string `json:"action"`
+	ContainerId string `json:"containerId,omitempty"`
+	Status string `json:"status"`
+	Created time.Time `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Set if the operation failed, as it would have been returned by a
+	// synchronous request
+	Error *Error `json:"error,omitempty"`
+}
+
+// A lifecycle action on the group or one of its containers
+type operation struct {
+	id          string
+	action      string
+	containerId string
+	created     time.Time
+	finished    time.Time
+	err         error
+}
+
+type operationInProgressError struct {
+	id string
+}
+
+func (err *operationInProgressError) Error() string {
+	return fmt.Sprintf("Operation %s is still running", err.id)
+}
+
+// Lifecycle actions started through the API, one runs at a time so actions
+// on the group and its containers don't interleave
+type operations struct {
+	byId    map[string]*operation
+	order   []string
+	running *operation
+	mutex   sync.Mutex
+}
+
+func newOperations() *operations {
+	return &operations{byId: make(map[string]*operation)}
+}
+
+func newOperationId() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// Register an operation, fails if another one is running
+func (operations *operations) begin(action string, containerId string) (*operation, error) {
+	operations.mutex.Lock()
+	defer operations.mutex.Unlock()
+	if operations.running != nil {
+		return nil, &operationInProgressError{id: operations.running.id}
+	}
+	operation := &operation{
+		id:          newOperationId(),
+		action:      action,
+		containerId: containerId,
+		created:     time.Now(),
+	}
+	operations.running = operation
+	operations.byId[operation.id] = operation
+	operations.order = append(operations.order, operation.id)
+	if len(operations.order) > operationHistorySize {
+		delete(operations.byId, operations.order[0])
+		operations.order = operations.order[1:]
+	}
+	return operation, nil
+}
+
+func (operations *operations) finish(operation *operation, err error) {
+	operations.mutex.Lock()
+	defer operations.mutex.Unlock()
+	operation.finished = time.Now()
+	operation.err = err
+	if operations.running == operation {
+		operations.running = nil
+	}
+}
+
+func (operations *operations) get(id string) (Operation, bool) {
+	operations.mutex.Lock()
+	defer operations.mutex.Unlock()
+	operation, found := operations.byId[id]
+	if !found {
+		return Operation{}, false
+	}
+	return operation.snapshot(), true
+}
+
+// Must be called with the operations locked
+func (operation *operation) snapshot() Operation {
+	operationDTO := Operation {
+		Id: operation.id,
+		Action: operation.action,
+		ContainerId: operation.containerId,
+		Status: OperationRunning,
+		Created: operation.created,
+	}
+	if operation.finished.IsZero() {
+		return operationDTO
+	}
+	finished := operation.finished
+	operationDTO.Finished = &finished
+	operationDTO.Status = OperationSucceeded
+	if operation.err != nil {
+		operationDTO.Status = OperationFailed
+		_, errorDTO := mapErrorToErrorDTO(operation.err)
+		operationDTO.Error = &errorDTO
+	}
+	return operationDTO
+}
+
+// Events published when an action on the whole group succeeds, in order
+var groupActionEvents = map[string][]eventLog.Event{
+	"start": {{Type: eventLog.GroupStarted, Message: "Containers started through the API"}},
+	"stop":  {{Type: eventLog.GroupStopped, Message: "Containers stopped through the API"}},
+	"pause": {{Type: eventLog.GroupPaused, Message: "Containers paused through the API"}},
+	"restart": {
+		{Type: eventLog.GroupStopped, Message: "Containers stopped through the API for a restart"},
+		{Type: eventLog.GroupStarted, Message: "Containers started through the API for a restart"},
+	},
+}
+
+// Publish the events of a group action once it succeeded, so webhooks and
+// history see the transition like one made by the idle procedures. Starting
+// a running, stopping a stopped or pausing a paused group changes nothing and
+// publishes nothing.
+func (api Api) withGroupEvents(action string, run func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		wasRunning := api.ContainerGroup.AllContainersAreRunning()
+		wasPaused := api.ContainerGroup.AllContainersArePaused()
+		// Paused containers don't count as running, stopping them is a transition
+		wasStopped := api.ContainerGroup.AllContainersAreStopped() && !wasPaused
+		if err := run(ctx); err != nil {
+			return err
+		}
+		for _, event := range groupActionEvents[action] {
+			if (event.Type == eventLog.GroupStarted && action == "start" && wasRunning) ||
+				(event.Type == eventLog.GroupStopped && wasStopped) ||
+				(event.Type == eventLog.GroupPaused && wasPaused) {
+				continue
+			}
+			event.Group = api.ContainerGroup.Name
+			eventLog.Publish(event)
+		}
+		return nil
+	}
+}
+
+// Whether the client asked for the action to run in the background, with
+// ?async=true or a Prefer: respond-async header
+func asyncRequested(r *http.Request) (bool, error) {
+	if value := r.URL.Query().Get("async"); value != "" {
+		return strconv.ParseBool(value)
+	}
+	for _, preference := range r.Header.Values("Prefer") {
+		for _, token := range strings.Split(preference, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Run a lifecycle action, in the background with 202 and the operation if
+// the client asked for it, otherwise responding once it finished
+func (api Api) runOperation(w http.ResponseWriter, r *http.Request, action string, containerId string, run func(ctx context.Context) error) {
+	async, err := asyncRequested(r)
+	if err != nil {
+		writeInvalidRequest(w, err)
+		return
+	}
+	// Fail right away instead of in the background if there is nothing to act on
+	if containerId != "" && !api.ContainerGroup.ContainerExists(containerId) {
+		writeErrorToResponse(w, docker.ErrContainerNotFound)
+		return
+	}
+	if containerId == "" && !api.ContainerGroup.Discovered() {
+		writeErrorToResponse(w, docker.ErrGroupNotDiscovered)
+		return
+	}
+	operation, err := api.operations.begin(action, containerId)
+	if err != nil {
+		writeErrorToResponse(w, err)
+		return
+	}
+	if containerId == "" {
+		run = api.withGroupEvents(action, run)
+	}
+	if !async {
+		err := run(r.Context())
+		api.operations.finish(operation, err)
+		writeResultToResponse(w, err)
+		return
+	}
+	go func() {
+		err := run(context.Background())
+		if err != nil {
+			logger.Warn("Operation failed", "operation", operation.id, "action", action, logging.Err(err))
+		}
+		api.operations.finish(operation, err)
+	}()
+	operationDTO, _ := api.operations.get(operation.id)
+	w.Header().Set("Location", "/operations/"+operation.id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJsonToResponse(w, operationDTO)
+}
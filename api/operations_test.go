@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fuglesteg/timid/docker"
+	"github.com/fuglesteg/timid/eventLog"
+)
+
+// Stand-in for the parts of the Docker Engine API Timid uses, serving a
+// single container named game
+type fakeDocker struct {
+	status string
+	paused bool
+	mutex  sync.Mutex
+}
+
+var dockerRoute = regexp.MustCompile(`^(?:/v[0-9.]+)?(/.*)$`)
+
+func (fake *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	w.Header().Set("Api-Version", "1.43")
+	w.Header().Set("Content-Type", "application/json")
+	route := dockerRoute.FindStringSubmatch(r.URL.Path)[1]
+	switch route {
+	case "/_ping":
+		w.Write([]byte("OK"))
+	case "/containers/json":
+		json.NewEncoder(w).Encode([]map[string]any{
+			{"Id": testContainerId, "Names": []string{"/game"}, "Labels": map[string]string{}},
+		})
+	case "/containers/" + testContainerId + "/json":
+		json.NewEncoder(w).Encode(map[string]any{
+			"Id":    testContainerId,
+			"Name":  "/game",
+			"State": map[string]any{"Status": fake.status, "Paused": fake.paused},
+		})
+	case "/containers/" + testContainerId + "/start":
+		fake.status, fake.paused = "running", false
+		w.WriteHeader(http.StatusNoContent)
+	case "/containers/" + testContainerId + "/stop":
+		fake.status, fake.paused = "exited", false
+		w.WriteHeader(http.StatusNoContent)
+	case "/containers/" + testContainerId + "/pause":
+		fake.status, fake.paused = "paused", true
+		w.WriteHeader(http.StatusNoContent)
+	case "/containers/" + testContainerId + "/unpause":
+		fake.status, fake.paused = "running", false
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "not found"}`))
+	}
+}
+
+func newFakeDockerGroup(t *testing.T) *docker.ContainerGroup {
+	t.Helper()
+	server := httptest.NewServer(&fakeDocker{status: "running"})
+	t.Cleanup(server.Close)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+	controller, err := docker.NewDockerController()
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := controller.NewSingleContainerGroup("game")
+	if !group.Discovered() {
+		t.Fatal("Container of the fake Docker daemon not found")
+	}
+	return group
+}
+
+// Actions through the API publish the same events as the idle procedures,
+// but only for actual transitions
+func TestGroupActionsPublishEventsForTransitions(t *testing.T) {
+	api := newTestApi(t, newFakeDockerGroup(t))
+	handler := api.handler()
+	events, unsubscribe := eventLog.Subscribe()
+	defer unsubscribe()
+
+	for _, test := range []struct {
+		action string
+		events []string
+	}{
+		{"stop", []string{eventLog.GroupStopped}},
+		{"stop", nil},
+		{"start", []string{eventLog.GroupStarted}},
+		{"start", nil},
+		{"pause", []string{eventLog.GroupPaused}},
+		{"pause", nil},
+		{"restart", []string{eventLog.GroupStopped, eventLog.GroupStarted}},
+		{"pause", []string{eventLog.GroupPaused}},
+		{"stop", []string{eventLog.GroupStopped}},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/containers/"+test.action, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", test.action, recorder.Code, recorder.Body)
+		}
+		var published []string
+	Receive:
+		for {
+			select {
+			case event := <-events:
+				published = append(published, event.Type)
+			case <-time.After(50 * time.Millisecond):
+				break Receive
+			}
+		}
+		if len(published) != len(test.events) {
+			t.Fatalf("%s: published %v, want %v", test.action, published, test.events)
+		}
+		for i := range published {
+			if published[i] != test.events[i] {
+				t.Fatalf("%s: published %v, want %v", test.action, published, test.events)
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// Dashboard at /ui, a static page using the rest of the API
+func handleUi(mux *router) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(files)))
+	mux.HandleFunc("GET /ui", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ui/", http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,232 @@
+"use strict";
+
+// The dashboard is served at /ui/, the API one level up
+const api = new URL("../", window.location.href);
+const tokenStorageKey = "timid.token";
+const maxEvents = 50;
+const refreshInterval = 5000;
+const reconnectDelay = 5000;
+const eventTypes = [
+	"timid.started",
+	"container.joined",
+	"container.left",
+	"group.started",
+	"group.paused",
+	"group.stopped",
+	"group.wake-abort",
+	"policy.changed",
+	"error",
+];
+
+let authRequired = false;
+
+function element(tag, text, className) {
+	const node = document.createElement(tag);
+	if (text !== undefined) {
+		node.textContent = text;
+	}
+	if (className) {
+		node.className = className;
+	}
+	return node;
+}
+
+function row(...cells) {
+	const tr = element("tr");
+	for (const cell of cells) {
+		tr.append(element("td", cell));
+	}
+	return tr;
+}
+
+function formatTime(time) {
+	return time ? new Date(time).toLocaleString() : "";
+}
+
+function formatBytes(bytes) {
+	const units = ["B", "KiB", "MiB", "GiB"];
+	let unit = 0;
+	while (bytes >= 1024 && unit < units.length - 1) {
+		bytes /= 1024;
+		unit++;
+	}
+	return `${bytes.toFixed(unit === 0 ? 0 : 1)} ${units[unit]}`;
+}
+
+function showMessage(text, isError) {
+	const message = document.getElementById("message");
+	message.textContent = text;
+	message.className = isError ? "error" : "";
+}
+
+function authHeaders() {
+	const headers = {};
+	const token = localStorage.getItem(tokenStorageKey);
+	if (token) {
+		headers["Authorization"] = `Bearer ${token}`;
+	}
+	return headers;
+}
+
+// A rejected token is forgotten so the token form is shown again
+function checkAuthorized(response) {
+	if (response.status === 401) {
+		authRequired = true;
+		localStorage.removeItem(tokenStorageKey);
+		updateControls();
+	}
+}
+
+async function get(route) {
+	const response = await fetch(new URL(route, api), { headers: authHeaders() });
+	checkAuthorized(response);
+	if (!response.ok) {
+		throw new Error(`${route}: ${response.status} ${response.statusText}`);
+	}
+	return response.json();
+}
+
+async function errorText(response) {
+	const text = await response.text();
+	try {
+		const body = JSON.parse(text);
+		return body.message || body.error || text;
+	} catch {
+		return text || response.statusText;
+	}
+}
+
+async function post(route) {
+	const response = await fetch(new URL(route, api), { method: "POST", headers: authHeaders() });
+	checkAuthorized(response);
+	if (!response.ok) {
+		throw new Error(await errorText(response));
+	}
+}
+
+// Nothing is usable until a token is entered if the API requires one
+function updateControls() {
+	const locked = authRequired && !localStorage.getItem(tokenStorageKey);
+	document.getElementById("start").disabled = locked;
+	document.getElementById("stop").disabled = locked;
+	document.getElementById("token-form").hidden = !locked;
+}
+
+async function refreshInfo() {
+	const info = await get("info");
+	authRequired = info.authRequired;
+	updateControls();
+	document.getElementById("group-name").textContent = info.containerGroup.name || "Timid";
+	const state = document.getElementById("group-state");
+	state.textContent = info.containerGroup.state;
+	state.className = `state ${info.containerGroup.state}`;
+	document.title = `${info.containerGroup.name || "Timid"}: ${info.containerGroup.state}`;
+}
+
+async function refreshContainers() {
+	const containers = (await get("containers")) || [];
+	document.getElementById("containers").replaceChildren(
+		...containers.map(container => row(container.name, container.id.slice(0, 12), container.state)));
+}
+
+async function refreshConnections() {
+	const connections = await get("proxy/connections");
+	document.getElementById("connections").replaceChildren(
+		...connections.map(connection => row(
+			connection.clientAddress,
+			formatTime(connection.created),
+			formatTime(connection.lastUsed),
+			formatBytes(connection.bytesFromClient + connection.bytesFromServer))));
+}
+
+async function refresh() {
+	const results = await Promise.allSettled([refreshInfo(), refreshContainers(), refreshConnections()]);
+	const failed = results.find(result => result.status === "rejected");
+	if (failed) {
+		showMessage(`Failed to refresh: ${failed.reason.message}`, true);
+	}
+}
+
+function addEvent(event) {
+	const text = [formatTime(event.time), event.type, event.containerName, event.message]
+		.filter(Boolean).join("  ");
+	const events = document.getElementById("events");
+	events.prepend(element("li", text, event.type === "error" ? "error" : ""));
+	while (events.children.length > maxEvents) {
+		events.lastChild.remove();
+	}
+}
+
+// Read the server sent events of the stream, EventSource can't send the token
+async function readEvents() {
+	const response = await fetch(new URL("events/stream", api), { headers: authHeaders() });
+	checkAuthorized(response);
+	if (!response.ok) {
+		throw new Error(`events/stream: ${response.status} ${response.statusText}`);
+	}
+	const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+	let buffered = "";
+	for (;;) {
+		const { value, done } = await reader.read();
+		if (done) {
+			return;
+		}
+		buffered += value;
+		let end;
+		while ((end = buffered.indexOf("\n\n")) !== -1) {
+			const lines = buffered.slice(0, end).split("\n");
+			buffered = buffered.slice(end + 2);
+			const type = lines.find(line => line.startsWith("event: "))?.slice("event: ".length);
+			const data = lines.find(line => line.startsWith("data: "))?.slice("data: ".length);
+			if (eventTypes.includes(type) && data) {
+				addEvent(JSON.parse(data));
+				refresh();
+			}
+		}
+	}
+}
+
+async function followEvents() {
+	try {
+		document.getElementById("events").replaceChildren();
+		for (const event of await get("events")) {
+			addEvent(event);
+		}
+		await readEvents();
+	} catch (error) {
+		showMessage(`Failed to load events: ${error.message}`, true);
+	}
+	setTimeout(followEvents, reconnectDelay);
+}
+
+function action(button, route, pending, done) {
+	document.getElementById(button).addEventListener("click", async () => {
+		showMessage(pending, false);
+		try {
+			await post(route);
+			showMessage(done, false);
+		} catch (error) {
+			showMessage(error.message, true);
+		}
+		refresh();
+	});
+}
+
+action("start", "containers/start", "Starting...", "Started");
+action("stop", "containers/stop", "Stopping...", "Stopped");
+
+document.getElementById("token-form").addEventListener("submit", event => {
+	event.preventDefault();
+	const input = document.getElementById("token");
+	if (input.value) {
+		localStorage.setItem(tokenStorageKey, input.value);
+		input.value = "";
+		showMessage("", false);
+	}
+	updateControls();
+	refresh();
+});
+
+refresh();
+followEvents();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,117 @@
+package ctl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fuglesteg/timid/api"
+)
+
+const requestTimeout = 2 * time.Minute
+
+// Client of the Timid REST API
+type client struct {
+	server string
+	token  string
+	http   http.Client
+}
+
+func newClient(server string, token string) *client {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	return &client{server: strings.TrimSuffix(server, "/"), token: token}
+}
+
+func (client *client) newRequest(ctx context.Context, method string, route string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, client.server+route, nil)
+	if err != nil {
+		return nil, err
+	}
+	if client.token != "" {
+		request.Header.Set("Authorization", "Bearer "+client.token)
+	}
+	return request, nil
+}
+
+// Send a request and return the body, API errors are returned as errors
+func (client *client) do(method string, route string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	request, err := client.newRequest(ctx, method, route)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		return nil, responseError(response.Status, body)
+	}
+	return body, nil
+}
+
+func responseError(status string, body []byte) error {
+	var apiErr api.Error
+	if json.Unmarshal(body, &apiErr) != nil || apiErr.Message == "" {
+		return fmt.Errorf("%s: %s", status, strings.TrimSpace(string(body)))
+	}
+	messages := []string{fmt.Sprintf("%s: %s", status, apiErr.Message)}
+	if apiErr.Details == nil {
+		return errors.New(messages[0])
+	}
+	for _, containerErr := range apiErr.Details.Containers {
+		messages = append(messages, fmt.Sprintf("  %s (%s): %s", containerErr.Name, containerErr.Id, containerErr.Error))
+	}
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+func (client *client) get(route string, value any) ([]byte, error) {
+	body, err := client.do(http.MethodGet, route)
+	if err != nil {
+		return nil, err
+	}
+	return body, json.Unmarshal(body, value)
+}
+
+// Follow a server sent events stream, calling onData with the data of every
+// event until the stream ends
+func (client *client) stream(route string, onData func(data []byte) error) error {
+	request, err := client.newRequest(context.Background(), http.MethodGet, route)
+	if err != nil {
+		return err
+	}
+	response, err := client.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(response.Body)
+		return responseError(response.Status, body)
+	}
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+		if err := onData([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
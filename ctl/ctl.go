@@ -0,0 +1,273 @@
+package ctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fuglesteg/timid/api"
+	"github.com/fuglesteg/timid/envInit"
+	"github.com/fuglesteg/timid/eventLog"
+)
+
+var (
+	serverKey   = envInit.EnvKey("TIMID_CTL_SERVER")
+	tokenKey    = envInit.EnvKey("TIMID_CTL_TOKEN")
+	apiPortKey  = envInit.EnvKey("TIMID_API_PORT")
+	apiTokenKey = envInit.EnvKey("TIMID_API_TOKEN")
+)
+
+// Where results and errors are printed
+var (
+	output      io.Writer = os.Stdout
+	errorOutput io.Writer = os.Stderr
+)
+
+const usage = `Usage: timid ctl [flags] <command>
+
+Commands:
+  status                              State of the group, the proxy and Docker
+  containers ls                       Containers in the group
+  start|stop|pause|restart [id]       Act on the group or a single container
+  connections                         Connections to the proxy
+  events [--follow]                   Recent events, --follow streams new ones
+  trigger                             Trigger the proxy as if a connection was made
+
+Flags:
+`
+
+type options struct {
+	server string
+	token  string
+	json   bool
+	follow bool
+}
+
+// Run the ctl subcommand, returns the exit code
+func Run(args []string) int {
+	apiPort, _ := apiPortKey.GetEnvIntOrFallback(80)
+	defaultServer, _ := serverKey.GetEnvStringOrFallback(fmt.Sprintf("127.0.0.1:%d", apiPort))
+	apiToken, _ := apiTokenKey.GetEnvStringOrFallback("")
+	defaultToken, _ := tokenKey.GetEnvStringOrFallback(apiToken)
+
+	var options options
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	flags.SetOutput(errorOutput)
+	flags.StringVar(&options.server, "server", defaultServer, "Address of the Timid REST API, defaults to TIMID_CTL_SERVER")
+	flags.StringVar(&options.token, "token", defaultToken, "Bearer token sent to the API, defaults to TIMID_CTL_TOKEN or TIMID_API_TOKEN")
+	flags.BoolVar(&options.json, "json", false, "Print JSON instead of tables")
+	flags.BoolVar(&options.follow, "follow", false, "Keep streaming events")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	client := newClient(options.server, options.token)
+	err = runCommand(client, options, positional)
+	if errors.Is(err, errUsage) {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(errorOutput, err)
+		return 1
+	}
+	return 0
+}
+
+var errUsage = errors.New("Invalid command")
+
+// Parse flags wherever they are among the arguments, returns the positional
+// arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func runCommand(client *client, options options, args []string) error {
+	switch args[0] {
+	case "status":
+		return status(client, options)
+	case "containers":
+		if len(args) != 2 || args[1] != "ls" {
+			return errUsage
+		}
+		return listContainers(client, options)
+	case "start", "stop", "pause", "restart":
+		switch len(args) {
+		case 1:
+			return action(client, "/containers/"+args[0])
+		case 2:
+			return action(client, "/containers/"+url.PathEscape(args[1])+"/"+args[0])
+		}
+		return errUsage
+	case "connections":
+		return listConnections(client, options)
+	case "events":
+		if options.follow {
+			return followEvents(client, options)
+		}
+		return listEvents(client, options)
+	case "trigger":
+		return action(client, "/proxy/trigger")
+	}
+	return errUsage
+}
+
+func printJson(body []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return err
+	}
+	fmt.Fprintln(output, indented.String())
+	return nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+}
+
+func status(client *client, options options) error {
+	var info api.Info
+	body, err := client.get("/info", &info)
+	if err != nil {
+		return err
+	}
+	if options.json {
+		return printJson(body)
+	}
+	table := newTable()
+	fmt.Fprintf(table, "Group:\t%s\n", info.ContainerGroup.Name)
+	fmt.Fprintf(table, "State:\t%s\n", info.ContainerGroup.State)
+	fmt.Fprintf(table, "Connections:\t%d\n", info.Connections)
+	docker := "reachable"
+	if !info.Docker.Reachable {
+		docker = "unreachable: " + info.Docker.Error
+	}
+	fmt.Fprintf(table, "Docker:\t%s\n", docker)
+	return table.Flush()
+}
+
+func listContainers(client *client, options options) error {
+	var containers []api.Container
+	body, err := client.get("/containers", &containers)
+	if err != nil {
+		return err
+	}
+	if options.json {
+		return printJson(body)
+	}
+	table := newTable()
+	fmt.Fprintln(table, "ID\tNAME\tSTATE")
+	for _, container := range containers {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", shortId(container.Id), strings.TrimPrefix(container.Name, "/"), container.State)
+	}
+	return table.Flush()
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[0:12]
+	}
+	return id
+}
+
+func action(client *client, route string) error {
+	_, err := client.do(http.MethodPost, route)
+	return err
+}
+
+func listConnections(client *client, options options) error {
+	var connections []api.Connection
+	body, err := client.get("/proxy/connections", &connections)
+	if err != nil {
+		return err
+	}
+	if options.json {
+		return printJson(body)
+	}
+	table := newTable()
+	fmt.Fprintln(table, "CLIENT\tCREATED\tLAST USED\tPACKETS IN\tBYTES IN\tPACKETS OUT\tBYTES OUT")
+	for _, connection := range connections {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			connection.ClientAddress,
+			connection.Created.Format(time.DateTime),
+			connection.LastUsed.Format(time.DateTime),
+			connection.PacketsFromClient,
+			connection.BytesFromClient,
+			connection.PacketsFromServer,
+			connection.BytesFromServer)
+	}
+	return table.Flush()
+}
+
+func formatEvent(event eventLog.Event) string {
+	line := []string{event.Time.Format(time.DateTime), event.Type}
+	if event.Group != "" {
+		line = append(line, "group="+event.Group)
+	}
+	if event.ContainerName != "" {
+		line = append(line, "container="+strings.TrimPrefix(event.ContainerName, "/"))
+	}
+	if event.Message != "" {
+		line = append(line, strconv.Quote(event.Message))
+	}
+	return strings.Join(line, " ")
+}
+
+func listEvents(client *client, options options) error {
+	var events []eventLog.Event
+	body, err := client.get("/events", &events)
+	if err != nil {
+		return err
+	}
+	if options.json {
+		return printJson(body)
+	}
+	for _, event := range events {
+		fmt.Fprintln(output, formatEvent(event))
+	}
+	return nil
+}
+
+func followEvents(client *client, options options) error {
+	return client.stream("/events/stream", func(data []byte) error {
+		if options.json {
+			fmt.Fprintln(output, string(data))
+			return nil
+		}
+		var event eventLog.Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+		fmt.Fprintln(output, formatEvent(event))
+		return nil
+	})
+}
@@ -0,0 +1,223 @@
+package ctl
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type request struct {
+	method        string
+	path          string
+	authorization string
+}
+
+// Stand-in for the Timid REST API with canned responses, the requests it got
+// are returned by the returned function
+func newStandIn(t *testing.T) (*httptest.Server, func() []request) {
+	t.Helper()
+	var requests []request
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, request{r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization")})
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.EscapedPath() {
+		case "GET /info":
+			fmt.Fprint(w, `{"connections": 2, "containerGroup": {"name": "valheim", "state": "Running"},`+
+				` "docker": {"reachable": false, "error": "connection refused"}, "authRequired": true}`)
+		case "GET /containers":
+			fmt.Fprint(w, `[{"id": "0123456789abcdef", "name": "/valheim-server", "state": "Running"}]`)
+		case "GET /proxy/connections":
+			fmt.Fprint(w, `[{"clientAddress": "203.0.113.7:50000", "created": "2024-05-01T12:00:00Z",`+
+				` "lastUsed": "2024-05-01T12:30:00Z", "packetsFromClient": 10, "bytesFromClient": 1000,`+
+				` "packetsFromServer": 20, "bytesFromServer": 20000}]`)
+		case "GET /events":
+			fmt.Fprint(w, `[{"time": "2024-05-01T12:00:00Z", "type": "group.started", "group": "valheim", "message": "Containers started"},`+
+				` {"time": "2024-05-01T13:00:00Z", "type": "container.left", "containerName": "/valheim-server"}]`)
+		case "GET /events/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: group.paused\ndata: {\"time\": \"2024-05-01T12:00:00Z\", \"type\": \"group.paused\", \"group\": \"valheim\"}\n\n")
+			fmt.Fprint(w, ": keepalive\n\n")
+			fmt.Fprint(w, "event: group.stopped\ndata: {\"time\": \"2024-05-01T12:05:00Z\", \"type\": \"group.stopped\", \"group\": \"valheim\"}\n\n")
+		case "POST /containers/start", "POST /containers/stop", "POST /containers/restart",
+			"POST /containers/abc%20def/restart", "POST /proxy/trigger":
+		case "POST /containers/pause":
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, `{"code": "docker_failed", "message": "Docker failed",`+
+				` "details": {"containers": [{"id": "0123456789ab", "name": "/valheim-server", "error": "timeout"}]}}`)
+		case "POST /containers/missing/stop":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"code": "container_not_found", "message": "Container not found"}`)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, "unexpected request")
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []request {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]request(nil), requests...)
+	}
+}
+
+// Run ctl with args, returning the exit code and what it printed
+func run(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	t.Setenv("TIMID_CTL_SERVER", "")
+	t.Setenv("TIMID_CTL_TOKEN", "")
+	t.Setenv("TIMID_API_TOKEN", "")
+	var stdout, stderr bytes.Buffer
+	previousOutput, previousErrorOutput := output, errorOutput
+	output, errorOutput = &stdout, &stderr
+	defer func() {
+		output, errorOutput = previousOutput, previousErrorOutput
+	}()
+	code := Run(args)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestOutput(t *testing.T) {
+	server, _ := newStandIn(t)
+	// Without a scheme http:// is assumed
+	address := strings.TrimPrefix(server.URL, "http://")
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "status",
+			args: []string{"--server", address, "status"},
+			want: "Group:        valheim\n" +
+				"State:        Running\n" +
+				"Connections:  2\n" +
+				"Docker:       unreachable: connection refused\n",
+		},
+		{
+			name: "status as JSON",
+			args: []string{"status", "--json", "--server", server.URL},
+			want: "{\n" +
+				"  \"connections\": 2,\n" +
+				"  \"containerGroup\": {\n" +
+				"    \"name\": \"valheim\",\n" +
+				"    \"state\": \"Running\"\n" +
+				"  },\n" +
+				"  \"docker\": {\n" +
+				"    \"reachable\": false,\n" +
+				"    \"error\": \"connection refused\"\n" +
+				"  },\n" +
+				"  \"authRequired\": true\n" +
+				"}\n",
+		},
+		{
+			name: "containers",
+			args: []string{"--server", server.URL, "containers", "ls"},
+			want: "ID            NAME            STATE\n" +
+				"0123456789ab  valheim-server  Running\n",
+		},
+		{
+			name: "connections",
+			args: []string{"--server", server.URL, "connections"},
+			want: "CLIENT             CREATED              LAST USED            PACKETS IN  BYTES IN  PACKETS OUT  BYTES OUT\n" +
+				"203.0.113.7:50000  2024-05-01 12:00:00  2024-05-01 12:30:00  10          1000      20           20000\n",
+		},
+		{
+			name: "events",
+			args: []string{"--server", server.URL, "events"},
+			want: "2024-05-01 12:00:00 group.started group=valheim \"Containers started\"\n" +
+				"2024-05-01 13:00:00 container.left container=valheim-server\n",
+		},
+		{
+			name: "following events",
+			args: []string{"--server", server.URL, "events", "--follow"},
+			want: "2024-05-01 12:00:00 group.paused group=valheim\n" +
+				"2024-05-01 12:05:00 group.stopped group=valheim\n",
+		},
+		{
+			name: "following events as JSON",
+			args: []string{"--server", server.URL, "--json", "events", "--follow"},
+			want: "{\"time\": \"2024-05-01T12:00:00Z\", \"type\": \"group.paused\", \"group\": \"valheim\"}\n" +
+				"{\"time\": \"2024-05-01T12:05:00Z\", \"type\": \"group.stopped\", \"group\": \"valheim\"}\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, stdout, stderr := run(t, test.args...)
+			if code != 0 {
+				t.Fatalf("Exit code %d: %s", code, stderr)
+			}
+			if stdout != test.want {
+				t.Errorf("Printed\n%s\nwant\n%s", stdout, test.want)
+			}
+		})
+	}
+}
+
+func TestActions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want request
+	}{
+		{[]string{"start"}, request{http.MethodPost, "/containers/start", ""}},
+		{[]string{"--token", "secret", "stop"}, request{http.MethodPost, "/containers/stop", "Bearer secret"}},
+		{[]string{"restart", "abc def"}, request{http.MethodPost, "/containers/abc%20def/restart", ""}},
+		{[]string{"trigger", "--token", "secret"}, request{http.MethodPost, "/proxy/trigger", "Bearer secret"}},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			server, requests := newStandIn(t)
+			code, stdout, stderr := run(t, append([]string{"--server", server.URL}, test.args...)...)
+			if code != 0 {
+				t.Fatalf("Exit code %d: %s", code, stderr)
+			}
+			if stdout != "" {
+				t.Errorf("Printed %q for an action", stdout)
+			}
+			if got := requests(); len(got) != 1 || got[0] != test.want {
+				t.Errorf("Requests %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server, _ := newStandIn(t)
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"no command", nil, 2, "Usage: timid ctl"},
+		{"unknown command", []string{"restore"}, 2, "Usage: timid ctl"},
+		{"containers without ls", []string{"containers"}, 2, "Usage: timid ctl"},
+		{"too many arguments", []string{"start", "a", "b"}, 2, "Usage: timid ctl"},
+		{"unknown flag", []string{"--verbose", "status"}, 2, "flag provided but not defined: -verbose"},
+		{"API error", []string{"stop", "missing"}, 1, "404 Not Found: Container not found\n"},
+		{"API error with containers", []string{"pause"}, 1,
+			"502 Bad Gateway: Docker failed\n  /valheim-server (0123456789ab): timeout\n"},
+		{"unreachable API", []string{"--server", "127.0.0.1:1", "status"}, 1, "connect"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, stdout, stderr := run(t, append([]string{"--server", server.URL}, test.args...)...)
+			if code != test.code {
+				t.Fatalf("Exit code %d, want %d: %s", code, test.code, stderr)
+			}
+			if stdout != "" {
+				t.Errorf("Printed %q on failure", stdout)
+			}
+			if !strings.Contains(stderr, test.stderr) {
+				t.Errorf("Printed error %q, want it to contain %q", stderr, test.stderr)
+			}
+		})
+	}
+}
@@ -1,6 +1,22 @@
 package docker
 
 type Container struct {
-	Name string
-	ID   string
+	Name   string
+	ID     string
+	Labels map[string]string
+}
+
+// State of a container as reported by Docker
+type ContainerState struct {
+	Status string // created, running, paused, restarting, removing, exited, dead or removed
+	Paused bool
+	Health string // Empty if the container has no health check
+}
+
+func (state ContainerState) IsRunning() bool {
+	return state.Status == "running" && !state.Paused
+}
+
+func (state ContainerState) IsPaused() bool {
+	return state.Status == "paused" || state.Paused
 }
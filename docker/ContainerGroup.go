@@ -1,30 +1,81 @@
 package docker
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
 
 type ContainerGroup struct  {
 	Name string
 	containers []*Container
 	dockerController *DockerController
+	stateCache containerStateCache
+	// How members are found, nil if the members never change
+	membership *groupMembership
+	// Guards containers while membership is reconciled
+	mutex sync.RWMutex
+	// How long starting a container waits for its dependencies
+	dependencyTimeout time.Duration
+	// How containers are stopped unless overridden by labels
+	stopConfig StopConfig
 }
 
 func (group *ContainerGroup) GetContainers() []*Container {
-	return group.containers
+	group.mutex.RLock()
+	defer group.mutex.RUnlock()
+	containers := make([]*Container, len(group.containers))
+	copy(containers, group.containers)
+	return containers
 }
 
 func NewContainerGroup(name string, containers []*Container, controller *DockerController) *ContainerGroup {
 	return &ContainerGroup{Name: name, containers: containers, dockerController: controller}
 }
 
-func (group *ContainerGroup) Start() {
-	for _, container := range group.containers {
-		group.dockerController.StartContainer(container.ID)
+// Whether any members of the group have been found. Docker might not be
+// running yet or the containers not be created yet when Timid starts, members
+// are picked up in the background once they appear.
+func (group *ContainerGroup) Discovered() bool {
+	group.mutex.RLock()
+	defer group.mutex.RUnlock()
+	return len(group.containers) > 0
+}
+
+func (group *ContainerGroup) Start(ctx context.Context) error {
+	if !group.Discovered() {
+		return ErrGroupNotDiscovered
+	}
+	return group.inStartOrder(ctx, group.startContainer)
+}
+
+// Whether the group is managed through Docker
+func (group *ContainerGroup) DockerEnabled() bool {
+	return group.dockerController != nil
+}
+
+// Whether the Docker daemon of the group can be reached
+func (group *ContainerGroup) DockerReachable() (bool, error) {
+	if !group.DockerEnabled() {
+		return false, ErrDockerDisabled
+	}
+	return group.dockerController.Reachable()
+}
+
+func (group *ContainerGroup) getContainer(containerId string) *Container {
+	for _, container := range group.GetContainers() {
+		if container.ID == containerId {
+			return container
+		}
 	}
+	return nil
 }
 
 func (group *ContainerGroup) ContainerExists(containerId string) bool {
 	exists := false
-	for _, container := range group.containers {
+	for _, container := range group.GetContainers() {
 		if container.ID == containerId {
 			exists = true
 			break
@@ -35,78 +86,139 @@ func (group *ContainerGroup) ContainerExists(containerId string) bool {
 
 func (group *ContainerGroup) ContainerIsPaused(containerId string) (bool, error) {
 	if group.ContainerExists(containerId) {
-		return group.dockerController.ContainerIsPaused(containerId), nil
+		return group.containerIsPaused(containerId), nil
 	} else {
-		return false, errors.New("Container does not exist in group")
+		return false, ErrContainerNotFound
 	}
 }
 
 func (group *ContainerGroup) ContainerIsRunning(containerId string) (bool, error) {
 	if group.ContainerExists(containerId) {
-		return group.dockerController.ContainerIsRunning(containerId), nil
+		return group.containerIsRunning(containerId), nil
 	} else {
-		return false, errors.New("Container does not exist in group")
+		return false, ErrContainerNotFound
 	}
 }
 
-func (group *ContainerGroup) StartContainer(containerId string) {
-	if group.ContainerExists(containerId) {
-		group.dockerController.StartContainer(containerId)
+// Run action on a single container of the group, returns
+// ErrContainerNotFound if the container is not in the group
+func (group *ContainerGroup) onContainer(ctx context.Context, containerId string, action func(ctx context.Context, container *Container) error) error {
+	container := group.getContainer(containerId)
+	if container == nil {
+		return ErrContainerNotFound
 	}
+	groupErrors := group.newGroupErrors()
+	groupErrors.add(container, action(ctx, container))
+	return groupErrors.err()
 }
 
-func (group *ContainerGroup) Stop() {
-	for _, container := range group.containers {
-		group.dockerController.StopContainer(container.ID)
+func (group *ContainerGroup) startContainer(ctx context.Context, container *Container) error {
+	if !group.DockerEnabled() {
+		return ErrDockerDisabled
 	}
+	err := group.dockerController.StartContainer(ctx, container.ID)
+	group.refreshState(container.ID)
+	return err
 }
 
-func (group *ContainerGroup) StopContainer(containerId string) {
-	if group.ContainerExists(containerId) {
-		group.dockerController.StopContainer(containerId)
-	}
+func (group *ContainerGroup) StartContainer(ctx context.Context, containerId string) error {
+	return group.onContainer(ctx, containerId, group.startContainer)
 }
 
-func (group *ContainerGroup) Pause() {
-	for _, container := range group.containers {
-		group.dockerController.PauseContainer(container.ID)
+// Stop the containers in stop order. Cancelling, for example because a
+// connection arrived, skips the containers not stopped yet. A stop in progress
+// is not cancelled, abandoning the request wouldn't keep the daemon from
+// stopping the container, so it is stopped once Stop returns.
+func (group *ContainerGroup) Stop(ctx context.Context) error {
+	if !group.Discovered() {
+		return ErrGroupNotDiscovered
+	}
+	groupErrors := group.newGroupErrors()
+	for _, container := range group.stopOrder() {
+		if ctx.Err() != nil {
+			groupErrors.add(container, ctx.Err())
+			continue
+		}
+		groupErrors.add(container, group.stopContainer(context.WithoutCancel(ctx), container))
 	}
+	return groupErrors.err()
 }
 
-func (group *ContainerGroup) PauseContainer(containerId string) {
-	if group.ContainerExists(containerId) {
-		group.dockerController.PauseContainer(containerId)
+func (group *ContainerGroup) StopContainer(ctx context.Context, containerId string) error {
+	return group.onContainer(ctx, containerId, group.stopContainer)
+}
+
+func (group *ContainerGroup) pauseContainer(ctx context.Context, container *Container) error {
+	if !group.DockerEnabled() {
+		return ErrDockerDisabled
 	}
+	err := group.dockerController.PauseContainer(ctx, container.ID)
+	group.refreshState(container.ID)
+	return err
 }
 
-func (group *ContainerGroup) Unpause() {
-	for _, container := range group.containers {
-		group.dockerController.UnpauseContainer(container.ID)
+// Pause the containers in stop order, cancelling works like for Stop
+func (group *ContainerGroup) Pause(ctx context.Context) error {
+	if !group.Discovered() {
+		return ErrGroupNotDiscovered
 	}
+	groupErrors := group.newGroupErrors()
+	for _, container := range group.stopOrder() {
+		if ctx.Err() != nil {
+			groupErrors.add(container, ctx.Err())
+			continue
+		}
+		groupErrors.add(container, group.pauseContainer(context.WithoutCancel(ctx), container))
+	}
+	return groupErrors.err()
 }
 
-func (group *ContainerGroup) UnpauseContainer(containerId string) {
-	if group.ContainerExists(containerId) {
-		group.dockerController.UnpauseContainer(containerId)
+func (group *ContainerGroup) PauseContainer(ctx context.Context, containerId string) error {
+	return group.onContainer(ctx, containerId, group.pauseContainer)
+}
+
+func (group *ContainerGroup) unpauseContainer(ctx context.Context, container *Container) error {
+	if !group.DockerEnabled() {
+		return ErrDockerDisabled
 	}
+	err := group.dockerController.UnpauseContainer(ctx, container.ID)
+	group.refreshState(container.ID)
+	return err
 }
 
-func (group *ContainerGroup) Restart() {
-	for _, container := range group.containers {
-		group.dockerController.RestartContainer(container.ID)
+func (group *ContainerGroup) Unpause(ctx context.Context) error {
+	if !group.Discovered() {
+		return ErrGroupNotDiscovered
 	}
+	return group.inStartOrder(ctx, group.unpauseContainer)
 }
 
-func (group *ContainerGroup) RestartContainer(containerId string) {
-	if group.ContainerExists(containerId) {
-		group.dockerController.RestartContainer(containerId)
+func (group *ContainerGroup) UnpauseContainer(ctx context.Context, containerId string) error {
+	return group.onContainer(ctx, containerId, group.unpauseContainer)
+}
+
+// Stop and start the group so dependencies are respected
+func (group *ContainerGroup) Restart(ctx context.Context) error {
+	if !group.Discovered() {
+		return ErrGroupNotDiscovered
 	}
+	return errors.Join(group.Stop(ctx), group.Start(ctx))
+}
+
+// Stop and start a single container, stopping it the same way as the group
+func (group *ContainerGroup) RestartContainer(ctx context.Context, containerId string) error {
+	return group.onContainer(ctx, containerId, func(ctx context.Context, container *Container) error {
+		if err := group.stopContainer(ctx, container); err != nil {
+			return err
+		}
+		return group.startContainer(ctx, container)
+	})
 }
 
 func (group *ContainerGroup) AnyContainerIsPaused() bool {
 	var isPaused bool = false
-	for _, container := range group.containers {
-		if group.dockerController.ContainerIsPaused(container.ID) {
+	for _, container := range group.GetContainers() {
+		if group.containerIsPaused(container.ID) {
 			isPaused = true
 		}
 	}
@@ -115,8 +227,8 @@ func (group *ContainerGroup) AnyContainerIsPaused() bool {
 
 func (group *ContainerGroup) AnyContainerIsStopped() bool {
 	var isStopped bool = false
-	for _, container := range group.containers {
-		if !group.dockerController.ContainerIsRunning(container.ID) {
+	for _, container := range group.GetContainers() {
+		if !group.containerIsRunning(container.ID) {
 			isStopped = true
 		}
 	}
@@ -125,8 +237,8 @@ func (group *ContainerGroup) AnyContainerIsStopped() bool {
 
 func (group *ContainerGroup) AnyContainerIsRunning() bool {
 	var isRunning bool = false
-	for _, container := range group.containers {
-		if group.dockerController.ContainerIsRunning(container.ID) {
+	for _, container := range group.GetContainers() {
+		if group.containerIsRunning(container.ID) {
 			isRunning = true
 		}
 	}
@@ -135,8 +247,8 @@ func (group *ContainerGroup) AnyContainerIsRunning() bool {
 
 func (group *ContainerGroup) AllContainersAreStopped() bool {
 	isStopped := true
-	for _, container := range group.containers {
-		if group.dockerController.ContainerIsRunning(container.ID) {
+	for _, container := range group.GetContainers() {
+		if group.containerIsRunning(container.ID) {
 			isStopped = false
 		}
 	}
@@ -145,8 +257,8 @@ func (group *ContainerGroup) AllContainersAreStopped() bool {
 
 func (group *ContainerGroup) AllContainersArePaused() bool {
 	isPaused := false
-	for _, container := range group.containers {
-		if group.dockerController.ContainerIsPaused(container.ID) {
+	for _, container := range group.GetContainers() {
+		if group.containerIsPaused(container.ID) {
 			isPaused = true
 		}
 	}
@@ -155,10 +267,24 @@ func (group *ContainerGroup) AllContainersArePaused() bool {
 
 func (group *ContainerGroup) AllContainersAreRunning() bool {
 	isRunning := true
-	for _, container := range group.containers {
-		if !group.dockerController.ContainerIsRunning(container.ID) {
+	for _, container := range group.GetContainers() {
+		if !group.containerIsRunning(container.ID) {
 			isRunning = false
 		}
 	}
 	return isRunning
 }
+
+// Run a command in the container of the group with the given name or compose
+// service
+func (group *ContainerGroup) ExecInContainer(ctx context.Context, reference string, command []string, timeout time.Duration) (string, error) {
+	if !group.DockerEnabled() {
+		return "", ErrDockerDisabled
+	}
+	for _, container := range group.GetContainers() {
+		if container.matches(reference) {
+			return group.dockerController.ExecInContainer(ctx, container.ID, command, timeout)
+		}
+	}
+	return "", fmt.Errorf("Container %s does not exist in group %s", reference, group.Name)
+}
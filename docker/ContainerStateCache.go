@@ -0,0 +1,178 @@
+package docker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/fuglesteg/timid/logging"
+)
+
+const (
+	eventsReconnectMinDelay = time.Second
+	eventsReconnectMaxDelay = 30 * time.Second
+)
+
+// Container states kept up to date from the Docker events stream
+type containerStateCache struct {
+	states map[string]ContainerState
+	// False while the events stream is disconnected, states might be stale
+	valid bool
+	mutex sync.RWMutex
+}
+
+func (cache *containerStateCache) get(containerId string) (ContainerState, bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if !cache.valid {
+		return ContainerState{}, false
+	}
+	state, found := cache.states[containerId]
+	return state, found
+}
+
+func (cache *containerStateCache) set(containerId string, state ContainerState) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.states == nil {
+		cache.states = make(map[string]ContainerState)
+	}
+	cache.states[containerId] = state
+}
+
+func (cache *containerStateCache) remove(containerId string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.states, containerId)
+}
+
+func (cache *containerStateCache) setValid(valid bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.valid = valid
+}
+
+// Subscribe to Docker events for the containers in the group and serve state
+// checks from a cache. Reconnects with a backoff if the stream fails, state
+// checks go to Docker directly while disconnected. Membership is also
+// reconciled every reconcileInterval, 0 disables it.
+func (group *ContainerGroup) Watch(reconcileInterval time.Duration) {
+	if group.membership != nil && reconcileInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(reconcileInterval)
+				if err := group.Reconcile(); err != nil {
+					logger.Warn("Failed to reconcile group members", logging.Group(group.Name), logging.Err(err))
+				}
+			}
+		}()
+	}
+	go func() {
+		delay := eventsReconnectMinDelay
+		for {
+			connected := time.Now()
+			err := group.watchEvents()
+			group.stateCache.setValid(false)
+			if time.Since(connected) > eventsReconnectMaxDelay {
+				delay = eventsReconnectMinDelay
+			}
+			logger.Error("Docker events stream disconnected, reconnecting", logging.Group(group.Name),
+				"delay", delay.String(), logging.Err(err))
+			time.Sleep(delay)
+			delay = min(delay*2, eventsReconnectMaxDelay)
+		}
+	}()
+}
+
+func (group *ContainerGroup) watchEvents() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, errs := group.dockerController.ContainerEvents(ctx, group.eventFilter())
+
+	// Refresh after subscribing so no changes are missed
+	if err := group.Reconcile(); err != nil {
+		return err
+	}
+	for _, containerId := range group.containerIds() {
+		if err := group.refreshState(containerId); err != nil {
+			return err
+		}
+	}
+	group.stateCache.setValid(true)
+	logger.Debug("Watching Docker events", logging.Group(group.Name))
+
+	for {
+		select {
+		case message := <-messages:
+			group.handleEvent(message)
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (group *ContainerGroup) handleEvent(message events.Message) {
+	containerId := message.Actor.ID
+	switch message.Action {
+	case events.ActionCreate, events.ActionDestroy, events.ActionRename:
+		if err := group.Reconcile(); err != nil {
+			logger.Warn("Failed to reconcile group members", logging.Group(group.Name), logging.Err(err))
+		}
+	}
+	if !group.ContainerExists(containerId) {
+		return
+	}
+	logger.Debug("Docker event", logging.Group(group.Name), logging.Container(containerId), "action", string(message.Action))
+	if err := group.refreshState(containerId); err != nil {
+		logger.Warn("Failed to refresh container state", logging.Group(group.Name), logging.Container(containerId), logging.Err(err))
+	}
+}
+
+func (group *ContainerGroup) refreshState(containerId string) error {
+	if !group.DockerEnabled() {
+		return ErrDockerDisabled
+	}
+	state, err := group.dockerController.InspectContainerState(context.Background(), containerId)
+	if err != nil {
+		return err
+	}
+	group.stateCache.set(containerId, state)
+	return nil
+}
+
+func (group *ContainerGroup) containerIds() []string {
+	var containerIds []string
+	for _, container := range group.GetContainers() {
+		containerIds = append(containerIds, container.ID)
+	}
+	return containerIds
+}
+
+func (group *ContainerGroup) containerState(containerId string) (ContainerState, error) {
+	if state, found := group.stateCache.get(containerId); found {
+		return state, nil
+	}
+	if !group.DockerEnabled() {
+		return ContainerState{}, ErrDockerDisabled
+	}
+	return group.dockerController.InspectContainerState(context.Background(), containerId)
+}
+
+func (group *ContainerGroup) containerIsRunning(containerId string) bool {
+	state, err := group.containerState(containerId)
+	if err != nil {
+		logger.Error("Failed to get container state", logging.Group(group.Name), logging.Container(containerId), logging.Err(err))
+		return false
+	}
+	return state.IsRunning()
+}
+
+func (group *ContainerGroup) containerIsPaused(containerId string) bool {
+	state, err := group.containerState(containerId)
+	if err != nil {
+		logger.Error("Failed to get container state", logging.Group(group.Name), logging.Container(containerId), logging.Err(err))
+		return false
+	}
+	return state.IsPaused()
+}
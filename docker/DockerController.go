@@ -1,121 +1,278 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	dContainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
-	"github.com/fuglesteg/timid/verboseLog"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/fuglesteg/timid/logging"
 )
 
+var logger = logging.For(logging.Docker)
+
 type DockerController struct {
 	client *client.Client
+	timeouts Timeouts
+	// Set while the daemon can't be reached
+	unreachableErr error
+	reachabilityMutex sync.Mutex
 }
 
-func NewDockerController() *DockerController {
-	context := context.Background()
+// Fails only if the client can't be created from the environment, for example
+// because of an invalid DOCKER_HOST. An unreachable daemon is not an error,
+// it is waited for in the background
+func NewDockerController() (*DockerController, error) {
 	client, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
-		verboseLog.Checkreport(1, err)
+		return nil, fmt.Errorf("Failed to create Docker client: %w", err)
 	}
-	client.NegotiateAPIVersion(context)
 	dockerController := new(DockerController)
 	dockerController.client = client
-	return dockerController
+	if err := dockerController.ping(); err != nil {
+		logger.Error("Docker daemon is unreachable", logging.Err(err))
+		dockerController.unreachableErr = err
+	}
+	go dockerController.monitorReachability()
+	return dockerController, nil
 }
 
-func (controller *DockerController) StopContainer(containerId string) {
-	err := controller.client.ContainerStop(context.Background(), containerId, dContainer.StopOptions{})
-	if err != nil {
-		verboseLog.Checkreport(1, err)
+const (
+	retryAttempts       = 3
+	retryInitialBackoff = 500 * time.Millisecond
+)
+
+// Errors that are likely to go away when the operation is tried again,
+// connection failures are not retried so an unreachable daemon fails fast
+func isTransient(err error) bool {
+	return errdefs.IsUnavailable(err) ||
+		errdefs.IsSystem(err)
+}
+
+// Run a Docker operation within the timeout, retrying with backoff on
+// transient daemon errors
+func (controller *DockerController) run(ctx context.Context, timeout time.Duration, operation string, containerId string, run func(ctx context.Context) error) error {
+	if err := controller.checkReachable(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := run(ctx)
+		controller.observe(err)
+		if err == nil || !isTransient(err) || attempt == retryAttempts {
+			return err
+		}
+		logger.Warn("Docker operation failed, retrying", "operation", operation, logging.Container(containerId),
+			"backoff", backoff.String(), logging.Err(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
 	}
 }
 
-func (controller *DockerController) PauseContainer(containerId string) {
-	err := controller.client.ContainerPause(context.Background(), containerId)
-	if err != nil {
-		verboseLog.Checkreport(1, err)
+func (controller *DockerController) StopContainer(ctx context.Context, containerId string) error {
+	return controller.StopContainerWithOptions(ctx, containerId, "", 0)
+}
+
+// Stop the container with the given signal and timeout, an empty signal and
+// a timeout of 0 use the defaults of the container
+func (controller *DockerController) StopContainerWithOptions(ctx context.Context, containerId string, signal string, timeout time.Duration) error {
+	stopOptions := dContainer.StopOptions{Signal: signal}
+	if timeout > 0 {
+		timeoutSeconds := int(math.Ceil(timeout.Seconds()))
+		stopOptions.Timeout = &timeoutSeconds
 	}
+	// Leave Docker time to kill the container after the stop timeout
+	operationTimeout := max(controller.timeouts.orDefault(controller.timeouts.Stop), timeout+10*time.Second)
+	return controller.run(ctx, operationTimeout, "Stop", containerId, func(ctx context.Context) error {
+		return controller.client.ContainerStop(ctx, containerId, stopOptions)
+	})
 }
 
-func (controller *DockerController) UnpauseContainer(containerId string) {
-	err := controller.client.ContainerUnpause(context.Background(), containerId)
+// Run a command in the container and wait for it to finish, returns the
+// combined output of the command
+func (controller *DockerController) ExecInContainer(ctx context.Context, containerId string, command []string, timeout time.Duration) (string, error) {
+	if err := controller.checkReachable(); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	execOptions := dContainer.ExecOptions{Cmd: command, AttachStdout: true, AttachStderr: true}
+	exec, err := controller.client.ContainerExecCreate(ctx, containerId, execOptions)
+	controller.observe(err)
 	if err != nil {
-		verboseLog.Checkreport(1, err)
+		return "", err
 	}
-}
+	attach, err := controller.client.ContainerExecAttach(ctx, exec.ID, dContainer.ExecAttachOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer attach.Close()
 
-func (controller *DockerController) StartContainer(containerId string) {
-	err := controller.client.ContainerStart(context.Background(), containerId, dContainer.StartOptions{})
+	var output bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(&output, &output, attach.Reader)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			return "", err
+		}
+	case <-ctx.Done():
+		return "", fmt.Errorf("Command %v in container %s timed out after %s", command, containerId, timeout.String())
+	}
+
+	inspect, err := controller.client.ContainerExecInspect(ctx, exec.ID)
 	if err != nil {
-		verboseLog.Checkreport(1, err)
+		return output.String(), err
 	}
+	if inspect.ExitCode != 0 {
+		return output.String(), fmt.Errorf("Command %v in container %s exited with code %d", command, containerId, inspect.ExitCode)
+	}
+	return output.String(), nil
 }
 
-func (controller *DockerController) RestartContainer(containerId string) {
-	err := controller.client.ContainerRestart(context.Background(), containerId, dContainer.StopOptions{})
+func (controller *DockerController) PauseContainer(ctx context.Context, containerId string) error {
+	timeout := controller.timeouts.orDefault(controller.timeouts.Pause)
+	return controller.run(ctx, timeout, "Pause", containerId, func(ctx context.Context) error {
+		return controller.client.ContainerPause(ctx, containerId)
+	})
+}
+
+func (controller *DockerController) UnpauseContainer(ctx context.Context, containerId string) error {
+	timeout := controller.timeouts.orDefault(controller.timeouts.Unpause)
+	return controller.run(ctx, timeout, "Unpause", containerId, func(ctx context.Context) error {
+		return controller.client.ContainerUnpause(ctx, containerId)
+	})
+}
+
+func (controller *DockerController) StartContainer(ctx context.Context, containerId string) error {
+	timeout := controller.timeouts.orDefault(controller.timeouts.Start)
+	return controller.run(ctx, timeout, "Start", containerId, func(ctx context.Context) error {
+		return controller.client.ContainerStart(ctx, containerId, dContainer.StartOptions{})
+	})
+}
+
+func (controller *DockerController) InspectContainerState(ctx context.Context, containerId string) (ContainerState, error) {
+	var info types.ContainerJSON
+	timeout := controller.timeouts.orDefault(controller.timeouts.Inspect)
+	err := controller.run(ctx, timeout, "Inspect", containerId, func(ctx context.Context) error {
+		var err error
+		info, err = controller.client.ContainerInspect(ctx, containerId)
+		return err
+	})
 	if err != nil {
-		verboseLog.Checkreport(1, err)
+		return ContainerState{}, err
 	}
+	state := ContainerState{
+		Status: info.State.Status,
+		Paused: info.State.Paused,
+	}
+	if info.State.Health != nil {
+		state.Health = info.State.Health.Status
+	}
+	return state, nil
 }
 
 func (controller *DockerController) ContainerIsRunning(containerId string) bool {
-	info, err := controller.client.ContainerInspect(context.Background(), containerId)
+	state, err := controller.InspectContainerState(context.Background(), containerId)
 	if err != nil {
-		verboseLog.Checkreport(1, err)
+		logger.Error("Failed to inspect container", logging.Container(containerId), logging.Err(err))
 		return false
 	}
-	return info.State.Status == "running" && !info.State.Paused
+	return state.IsRunning()
 }
 
 func (controller *DockerController) ContainerIsPaused(containerId string) bool {
-	info, err := controller.client.ContainerInspect(context.Background(), containerId)
+	state, err := controller.InspectContainerState(context.Background(), containerId)
 	if err != nil {
-		verboseLog.Checkreport(1, err)
+		logger.Error("Failed to inspect container", logging.Container(containerId), logging.Err(err))
 		return false
 	}
-	return info.State.Status == "paused" || info.State.Paused
+	return state.IsPaused()
+}
+
+// Subscribe to Docker container events matching the filter, the
+// subscription ends when the context is cancelled or an error is sent
+func (controller *DockerController) ContainerEvents(ctx context.Context, filterArgs filters.Args) (<-chan events.Message, <-chan error) {
+	filterArgs = filterArgs.Clone()
+	filterArgs.Add("type", string(events.ContainerEventType))
+	return controller.client.Events(ctx, events.ListOptions{Filters: filterArgs})
 }
 
 func (controller *DockerController) NewContainer(containerName string) (*Container, error) {
-	filterArgs := filters.NewArgs(
-		filters.Arg("name", containerName),
-	)
-	listOptions := dContainer.ListOptions{All: true, Filters: filterArgs}
-	containers, err :=
-		controller.client.ContainerList(context.Background(), listOptions)
+	membership := &groupMembership{name: containerName}
+	containers, err := controller.listContainers(context.Background(), membership.filterArgs())
 	if err != nil {
 		return nil, err
 	}
-	containerId := containers[0].ID
-	container := &Container{Name: containerName, ID: containerId}
-	return container, nil
+	if len(containers) <= 0 {
+		return nil, errors.New("No container found with name: " + containerName)
+	}
+	return containers[0], nil
 }
 
-func (controller *DockerController) NewContainerGroup(groupName string) (*ContainerGroup, error) {
-	filterArgs := filters.NewArgs(
-		filters.Arg("label", "timid.group." + groupName),
-	)
+func (controller *DockerController) listContainers(ctx context.Context, filterArgs filters.Args) ([]*Container, error) {
 	listOptions := dContainer.ListOptions{All: true, Filters: filterArgs}
-	filteredContainers, err :=
-		controller.client.ContainerList(context.Background(), listOptions)
+	var listedContainers []types.Container
+	timeout := controller.timeouts.orDefault(controller.timeouts.List)
+	err := controller.run(ctx, timeout, "List", "", func(ctx context.Context) error {
+		var err error
+		listedContainers, err = controller.client.ContainerList(ctx, listOptions)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(filteredContainers) <= 0 {
-		return nil, errors.New("No containers found with label: " + "timid.group." + groupName)
+	var containers []*Container
+	for _, container := range listedContainers {
+		containers = append(containers, &Container{Name: container.Names[0], ID: container.ID, Labels: container.Labels})
 	}
-	var initializedContainers []*Container
-	for _, container := range filteredContainers {
-		container := &Container{Name: container.Names[0], ID: container.ID}
-		initializedContainers = append(initializedContainers, container)
+	return containers, nil
+}
+
+// Group of the containers labeled timid.group.<groupName>. Members are
+// discovered by ContainerGroup.Watch, so the group can be created before
+// the daemon is reachable or the containers exist.
+func (controller *DockerController) NewContainerGroup(groupName string) *ContainerGroup {
+	membership := &groupMembership{label: "timid.group." + groupName}
+	return controller.newDiscoveredGroup(groupName, membership)
+}
+
+// Group consisting of the single container with the given name
+func (controller *DockerController) NewSingleContainerGroup(containerName string) *ContainerGroup {
+	membership := &groupMembership{name: containerName}
+	return controller.newDiscoveredGroup(containerName, membership)
+}
+
+func (controller *DockerController) newDiscoveredGroup(name string, membership *groupMembership) *ContainerGroup {
+	containerGroup := &ContainerGroup {
+		Name: name,
+		dockerController: controller,
+		membership: membership,
 	}
-	containerGroup := ContainerGroup {
-		Name: groupName, 
-		dockerController: controller, 
-		containers: initializedContainers,
+	err := containerGroup.Reconcile()
+	if err != nil {
+		logger.Error("Failed to discover containers, retrying in the background", logging.Group(name), logging.Err(err))
+	} else if !containerGroup.Discovered() {
+		logger.Info("No containers found yet, waiting for them to be created", logging.Group(name))
 	}
-	return &containerGroup, nil
+	return containerGroup
 }
@@ -0,0 +1,90 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+)
+
+var ErrContainerNotFound = errors.New("Container does not exist in group")
+
+// Returned by group operations until members of the group have been found
+var ErrGroupNotDiscovered = errors.New("No containers of the group have been found yet")
+
+// Returned by operations on the containers of a group without a Docker
+// controller
+var ErrDockerDisabled = errors.New("Docker functionality disabled")
+
+// Error from a Docker operation on a single container
+type ContainerError struct {
+	Container *Container
+	Err       error
+}
+
+func (err *ContainerError) Error() string {
+	return fmt.Sprintf("Container %s: %s", err.Container.Name, err.Err.Error())
+}
+
+func (err *ContainerError) Unwrap() error {
+	return err.Err
+}
+
+// Errors from an operation on the containers of a group, one per failed
+// container
+type GroupError struct {
+	Group  string
+	Errors []*ContainerError
+}
+
+func (err *GroupError) Error() string {
+	var messages []string
+	for _, containerErr := range err.Errors {
+		messages = append(messages, containerErr.Error())
+	}
+	return fmt.Sprintf("Group %s: %s", err.Group, strings.Join(messages, "; "))
+}
+
+func (err *GroupError) Unwrap() []error {
+	var errs []error
+	for _, containerErr := range err.Errors {
+		errs = append(errs, containerErr)
+	}
+	return errs
+}
+
+// Docker refused the operation on every failed container because of the
+// container's state, for example when pausing a stopped container
+func (err *GroupError) Conflict() bool {
+	for _, containerErr := range err.Errors {
+		if !errdefs.IsConflict(containerErr.Err) {
+			return false
+		}
+	}
+	return len(err.Errors) > 0
+}
+
+// Collects the errors of an operation on the containers of a group
+type groupErrors struct {
+	group  *ContainerGroup
+	errors []*ContainerError
+}
+
+func (group *ContainerGroup) newGroupErrors() *groupErrors {
+	return &groupErrors{group: group}
+}
+
+func (groupErrors *groupErrors) add(container *Container, err error) {
+	if err != nil {
+		groupErrors.errors = append(groupErrors.errors, &ContainerError{Container: container, Err: err})
+	}
+}
+
+// nil if no container failed
+func (groupErrors *groupErrors) err() error {
+	if len(groupErrors.errors) == 0 {
+		return nil
+	}
+	return &GroupError{Group: groupErrors.group.Name, Errors: groupErrors.errors}
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/fuglesteg/timid/eventLog"
+	"github.com/fuglesteg/timid/logging"
+)
+
+// Containers are members of a group by label or by name, so recreated
+// containers are picked up even though their ID changes
+type groupMembership struct {
+	label string // Containers with this label are members
+	name  string // The container with exactly this name is the member
+}
+
+// Filter for listing the members
+func (membership *groupMembership) filterArgs() filters.Args {
+	if membership.label != "" {
+		return filters.NewArgs(filters.Arg("label", membership.label))
+	}
+	return filters.NewArgs(filters.Arg("name", fmt.Sprintf("^/%s$", membership.name)))
+}
+
+// Filter for events of the members, the events stream has no name filter but
+// its container filter matches the exact name
+func (membership *groupMembership) eventFilterArgs() filters.Args {
+	if membership.label != "" {
+		return filters.NewArgs(filters.Arg("label", membership.label))
+	}
+	return filters.NewArgs(filters.Arg("container", membership.name))
+}
+
+func (group *ContainerGroup) eventFilter() filters.Args {
+	if group.membership != nil {
+		return group.membership.eventFilterArgs()
+	}
+	filterArgs := filters.NewArgs()
+	for _, containerId := range group.containerIds() {
+		filterArgs.Add("container", containerId)
+	}
+	return filterArgs
+}
+
+// Update the members of the group from Docker
+func (group *ContainerGroup) Reconcile() error {
+	if group.membership == nil {
+		return nil
+	}
+	containers, err := group.dockerController.listContainers(context.Background(), group.membership.filterArgs())
+	if err != nil {
+		return err
+	}
+
+	group.mutex.Lock()
+	wasDiscovered := len(group.containers) > 0
+	current := make(map[string]*Container)
+	for _, container := range group.containers {
+		current[container.ID] = container
+	}
+	var joined []*Container
+	for _, container := range containers {
+		if _, found := current[container.ID]; found {
+			delete(current, container.ID)
+		} else {
+			joined = append(joined, container)
+		}
+	}
+	group.containers = containers
+	group.mutex.Unlock()
+
+	if !wasDiscovered && len(containers) > 0 {
+		logger.Info("Discovered containers of group", logging.Group(group.Name))
+	}
+
+	for _, container := range joined {
+		logger.Info("Container joined group", logging.Group(group.Name), logging.Container(container.ID), logging.ContainerName(container.Name))
+		if err := group.refreshState(container.ID); err != nil {
+			logger.Warn("Failed to refresh container state", logging.Group(group.Name), logging.Container(container.ID), logging.Err(err))
+		}
+		eventLog.Publish(eventLog.Event{
+			Type:          eventLog.ContainerJoined,
+			Group:         group.Name,
+			ContainerId:   container.ID,
+			ContainerName: container.Name,
+		})
+	}
+	for _, container := range current {
+		logger.Info("Container left group", logging.Group(group.Name), logging.Container(container.ID), logging.ContainerName(container.Name))
+		group.stateCache.remove(container.ID)
+		eventLog.Publish(eventLog.Event{
+			Type:          eventLog.ContainerLeft,
+			Group:         group.Name,
+			ContainerId:   container.ID,
+			ContainerName: container.Name,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuglesteg/timid/logging"
+)
+
+const (
+	// Containers with a lower order are started first and stopped last
+	orderLabel = "timid.order"
+	// Comma separated names or compose services the container depends on
+	dependsOnLabel = "timid.depends-on"
+
+	composeServiceLabel = "com.docker.compose.service"
+
+	defaultDependencyTimeout = 2 * time.Minute
+)
+
+func (container *Container) order() int {
+	order, err := strconv.Atoi(container.Labels[orderLabel])
+	if err != nil {
+		return 0
+	}
+	return order
+}
+
+func (container *Container) dependencies() []string {
+	var dependencies []string
+	for _, dependency := range strings.Split(container.Labels[dependsOnLabel], ",") {
+		dependency = strings.TrimSpace(dependency)
+		if dependency != "" {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	return dependencies
+}
+
+// Whether the container is referred to by name, without the leading slash
+// Docker adds, or by its compose service
+func (container *Container) matches(reference string) bool {
+	return strings.TrimPrefix(container.Name, "/") == reference ||
+		container.Labels[composeServiceLabel] == reference ||
+		container.ID == reference
+}
+
+// Set how long starting a container waits for its dependencies to be running
+// or healthy
+func (group *ContainerGroup) SetDependencyTimeout(timeout time.Duration) {
+	group.dependencyTimeout = timeout
+}
+
+// Containers sorted so dependencies come before the containers depending on
+// them, ties are broken by the order label and then the name
+func (group *ContainerGroup) startOrder() ([]*Container, map[*Container][]*Container, error) {
+	containers := group.GetContainers()
+	sort.SliceStable(containers, func(i, j int) bool {
+		if containers[i].order() != containers[j].order() {
+			return containers[i].order() < containers[j].order()
+		}
+		return containers[i].Name < containers[j].Name
+	})
+
+	dependencies := make(map[*Container][]*Container)
+	dependents := make(map[*Container][]*Container)
+	remaining := make(map[*Container]int)
+	for _, container := range containers {
+		for _, reference := range container.dependencies() {
+			found := false
+			for _, dependency := range containers {
+				if dependency != container && dependency.matches(reference) {
+					dependencies[container] = append(dependencies[container], dependency)
+					dependents[dependency] = append(dependents[dependency], container)
+					found = true
+				}
+			}
+			if !found {
+				logger.Debug("Dependency is not in group", "dependency", reference,
+					logging.Container(container.ID), logging.ContainerName(container.Name), logging.Group(group.Name))
+			}
+		}
+		remaining[container] = len(dependencies[container])
+	}
+
+	var ordered []*Container
+	for len(ordered) < len(containers) {
+		progressed := false
+		for _, container := range containers {
+			if remaining[container] != 0 {
+				continue
+			}
+			remaining[container] = -1
+			ordered = append(ordered, container)
+			for _, dependent := range dependents[container] {
+				remaining[dependent]--
+			}
+			progressed = true
+			// Start over so the order label is respected among ready containers
+			break
+		}
+		if !progressed {
+			return containers, dependencies, fmt.Errorf("Dependency cycle in group %s", group.Name)
+		}
+	}
+	return ordered, dependencies, nil
+}
+
+func (group *ContainerGroup) stopOrder() []*Container {
+	ordered, _, err := group.startOrder()
+	if err != nil {
+		logger.Error("Failed to order containers", logging.Group(group.Name), logging.Err(err))
+	}
+	reversed := make([]*Container, len(ordered))
+	for i, container := range ordered {
+		reversed[len(ordered)-1-i] = container
+	}
+	return reversed
+}
+
+// A dependency is ready when it is running and, if it has a health check,
+// healthy
+func (group *ContainerGroup) waitUntilReady(ctx context.Context, container *Container) error {
+	timeout := group.dependencyTimeout
+	if timeout == 0 {
+		timeout = defaultDependencyTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := group.containerState(container.ID)
+		if err == nil && state.IsRunning() && (state.Health == "" || state.Health == "healthy") {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %s waiting for container %s to be ready", timeout.String(), container.Name)
+		}
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		// The events stream might not be connected
+		group.refreshState(container.ID)
+	}
+}
+
+// Run action for every container in start order, waiting for the
+// dependencies of each container to be ready first
+func (group *ContainerGroup) inStartOrder(ctx context.Context, action func(ctx context.Context, container *Container) error) error {
+	ordered, dependencies, err := group.startOrder()
+	if err != nil {
+		logger.Error("Failed to order containers", logging.Group(group.Name), logging.Err(err))
+	}
+	groupErrors := group.newGroupErrors()
+	for _, container := range ordered {
+		if ctx.Err() != nil {
+			groupErrors.add(container, ctx.Err())
+			continue
+		}
+		for _, dependency := range dependencies[container] {
+			logger.Debug("Waiting for dependency", "dependency", dependency.Name,
+				logging.Container(container.ID), logging.ContainerName(container.Name))
+			// Start anyway, the dependency might just be slow
+			groupErrors.add(container, group.waitUntilReady(ctx, dependency))
+		}
+		groupErrors.add(container, action(ctx, container))
+	}
+	return groupErrors.err()
+}
@@ -0,0 +1,129 @@
+package docker
+
+import (
+	"slices"
+	"testing"
+)
+
+// Container named name, labels are given as key, value pairs
+func labeledContainer(name string, labels ...string) *Container {
+	container := &Container{ID: name, Name: "/" + name, Labels: make(map[string]string)}
+	for i := 0; i+1 < len(labels); i += 2 {
+		container.Labels[labels[i]] = labels[i+1]
+	}
+	return container
+}
+
+func containerNames(containers []*Container) []string {
+	var names []string
+	for _, container := range containers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+func TestStartAndStopOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []*Container
+		start      []string
+		cycle      bool
+	}{
+		{
+			name:       "by name without labels",
+			containers: []*Container{labeledContainer("web"), labeledContainer("db"), labeledContainer("game")},
+			start:      []string{"/db", "/game", "/web"},
+		},
+		{
+			name: "order label first, then name",
+			containers: []*Container{
+				labeledContainer("a", orderLabel, "2"),
+				labeledContainer("b", orderLabel, "1"),
+				labeledContainer("c", orderLabel, "1"),
+				labeledContainer("d"),
+			},
+			start: []string{"/d", "/b", "/c", "/a"},
+		},
+		{
+			name: "invalid order label counts as 0",
+			containers: []*Container{
+				labeledContainer("a", orderLabel, "1"),
+				labeledContainer("b", orderLabel, "first"),
+			},
+			start: []string{"/b", "/a"},
+		},
+		{
+			name: "dependency before dependent despite order",
+			containers: []*Container{
+				labeledContainer("game", orderLabel, "0", dependsOnLabel, "db"),
+				labeledContainer("db", orderLabel, "5"),
+			},
+			start: []string{"/db", "/game"},
+		},
+		{
+			name: "dependencies by compose service and name",
+			containers: []*Container{
+				labeledContainer("project-game-1", composeServiceLabel, "game", dependsOnLabel, "database, cache"),
+				labeledContainer("project-database-1", composeServiceLabel, "database", dependsOnLabel, "cache"),
+				labeledContainer("cache"),
+			},
+			start: []string{"/cache", "/project-database-1", "/project-game-1"},
+		},
+		{
+			name: "missing dependency is ignored",
+			containers: []*Container{
+				labeledContainer("game", dependsOnLabel, "elsewhere"),
+				labeledContainer("db"),
+			},
+			start: []string{"/db", "/game"},
+		},
+		{
+			name: "cycle falls back to order and name",
+			containers: []*Container{
+				labeledContainer("c"),
+				labeledContainer("a", dependsOnLabel, "b"),
+				labeledContainer("b", dependsOnLabel, "a"),
+			},
+			start: []string{"/a", "/b", "/c"},
+			cycle: true,
+		},
+		{
+			name:       "container depending on itself is not a cycle",
+			containers: []*Container{labeledContainer("game", dependsOnLabel, "game")},
+			start:      []string{"/game"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := NewContainerGroup("test", test.containers, nil)
+			ordered, _, err := group.startOrder()
+			if (err != nil) != test.cycle {
+				t.Fatalf("Got error %v, want a cycle error: %v", err, test.cycle)
+			}
+			if got := containerNames(ordered); !slices.Equal(got, test.start) {
+				t.Errorf("Start order %v, want %v", got, test.start)
+			}
+			stop := slices.Clone(test.start)
+			slices.Reverse(stop)
+			if got := containerNames(group.stopOrder()); !slices.Equal(got, stop) {
+				t.Errorf("Stop order %v, want %v", got, stop)
+			}
+		})
+	}
+}
+
+func TestStartOrderDependencies(t *testing.T) {
+	game := labeledContainer("game", dependsOnLabel, "db,missing")
+	db := labeledContainer("db")
+	group := NewContainerGroup("test", []*Container{game, db}, nil)
+	_, dependencies, err := group.startOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dependencies[game]; len(got) != 1 || got[0] != db {
+		t.Errorf("Dependencies of game %v, want [/db]", containerNames(got))
+	}
+	if got := dependencies[db]; len(got) != 0 {
+		t.Errorf("Dependencies of db %v, want none", containerNames(got))
+	}
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/fuglesteg/timid/logging"
+)
+
+const reachabilityCheckInterval = 5 * time.Second
+
+var ErrDaemonUnreachable = errors.New("Docker daemon is unreachable")
+
+// Whether the Docker daemon could be reached, with the error if not
+func (controller *DockerController) Reachable() (bool, error) {
+	controller.reachabilityMutex.Lock()
+	defer controller.reachabilityMutex.Unlock()
+	if controller.unreachableErr != nil {
+		return false, controller.unreachableErr
+	}
+	return true, nil
+}
+
+// Fail fast instead of waiting for the deadline while the daemon is
+// unreachable
+func (controller *DockerController) checkReachable() error {
+	reachable, err := controller.Reachable()
+	if reachable {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrDaemonUnreachable, err.Error())
+}
+
+// Mark the daemon as unreachable if err is a connection failure
+func (controller *DockerController) observe(err error) {
+	if err == nil || !client.IsErrConnectionFailed(err) {
+		return
+	}
+	controller.reachabilityMutex.Lock()
+	defer controller.reachabilityMutex.Unlock()
+	if controller.unreachableErr == nil {
+		logger.Error("Lost connection to the Docker daemon", logging.Err(err))
+	}
+	controller.unreachableErr = err
+}
+
+func (controller *DockerController) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), reachabilityCheckInterval)
+	defer cancel()
+	_, err := controller.client.Ping(ctx)
+	if err == nil {
+		controller.client.NegotiateAPIVersion(ctx)
+	}
+	return err
+}
+
+// Ping the daemon while it is unreachable until it answers again
+func (controller *DockerController) monitorReachability() {
+	for {
+		time.Sleep(reachabilityCheckInterval)
+		if reachable, _ := controller.Reachable(); reachable {
+			continue
+		}
+		err := controller.ping()
+		controller.reachabilityMutex.Lock()
+		if err == nil {
+			logger.Info("Connection to the Docker daemon restored")
+			controller.unreachableErr = nil
+		} else {
+			controller.unreachableErr = err
+		}
+		controller.reachabilityMutex.Unlock()
+	}
+}
@@ -0,0 +1,114 @@
+package docker
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuglesteg/timid/logging"
+)
+
+const (
+	// Signal sent to stop the container, for example SIGINT
+	stopSignalLabel = "timid.stop-signal"
+	// Duration string, how long Docker waits before killing the container
+	stopTimeoutLabel = "timid.stop-timeout"
+	// Command run in the container with sh -c before it is stopped
+	preStopCommandLabel = "timid.pre-stop"
+	// Duration string, how long the pre-stop command may run
+	preStopTimeoutLabel = "timid.pre-stop-timeout"
+
+	defaultPreStopTimeout = time.Minute
+)
+
+// Signals Docker accepts by name, with or without the SIG prefix
+var signalNames = map[string]bool{
+	"ABRT": true, "ALRM": true, "BUS": true, "CHLD": true, "CONT": true, "FPE": true, "HUP": true,
+	"ILL": true, "INT": true, "IO": true, "IOT": true, "KILL": true, "PIPE": true, "POLL": true,
+	"PROF": true, "PWR": true, "QUIT": true, "SEGV": true, "STKFLT": true, "STOP": true, "SYS": true,
+	"TERM": true, "TRAP": true, "TSTP": true, "TTIN": true, "TTOU": true, "URG": true, "USR1": true,
+	"USR2": true, "VTALRM": true, "WINCH": true, "XCPU": true, "XFSZ": true,
+}
+
+// Whether Docker accepts the signal, a name like SIGINT or INT or a number
+func validSignal(signal string) bool {
+	if number, err := strconv.Atoi(signal); err == nil {
+		return number > 0 && number <= 64
+	}
+	return signalNames[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]
+}
+
+// How containers are stopped, set for a group and overridden per container
+// with labels
+type StopConfig struct {
+	Signal         string        // Empty uses the signal configured for the container in Docker
+	Timeout        time.Duration // 0 uses Docker's default timeout
+	PreStopCommand string        // Run with sh -c in the container before it is stopped
+	PreStopTimeout time.Duration // 0 uses a timeout of one minute
+}
+
+// An invalid signal is logged and the signal configured in Docker used instead
+func (group *ContainerGroup) SetStopConfig(config StopConfig) {
+	if config.Signal != "" && !validSignal(config.Signal) {
+		logger.Error("Invalid stop signal", logging.Group(group.Name), "signal", config.Signal)
+		config.Signal = ""
+	}
+	group.stopConfig = config
+}
+
+func (group *ContainerGroup) containerStopConfig(container *Container) StopConfig {
+	config := group.stopConfig
+	if signal, found := container.Labels[stopSignalLabel]; found {
+		if validSignal(signal) {
+			config.Signal = signal
+		} else {
+			logger.Error("Invalid stop signal label", logging.Container(container.ID), "signal", signal)
+		}
+	}
+	if command, found := container.Labels[preStopCommandLabel]; found {
+		config.PreStopCommand = command
+	}
+	if timeout, found := container.Labels[stopTimeoutLabel]; found {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			logger.Error("Invalid stop timeout label", logging.Container(container.ID), logging.Err(err))
+		} else {
+			config.Timeout = duration
+		}
+	}
+	if timeout, found := container.Labels[preStopTimeoutLabel]; found {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			logger.Error("Invalid pre-stop timeout label", logging.Container(container.ID), logging.Err(err))
+		} else {
+			config.PreStopTimeout = duration
+		}
+	}
+	if config.PreStopTimeout == 0 {
+		config.PreStopTimeout = defaultPreStopTimeout
+	}
+	return config
+}
+
+// Run the pre-stop command if the container is running, then stop it. A
+// failing pre-stop command is logged but does not prevent the stop
+func (group *ContainerGroup) stopContainer(ctx context.Context, container *Container) error {
+	if !group.DockerEnabled() {
+		return ErrDockerDisabled
+	}
+	config := group.containerStopConfig(container)
+	if config.PreStopCommand != "" && group.containerIsRunning(container.ID) {
+		logger.Debug("Running pre-stop command", logging.Container(container.ID), logging.ContainerName(container.Name),
+			"command", config.PreStopCommand)
+		output, err := group.dockerController.ExecInContainer(ctx, container.ID,
+			[]string{"sh", "-c", config.PreStopCommand}, config.PreStopTimeout)
+		if err != nil {
+			logger.Error("Pre-stop command failed", logging.Container(container.ID), logging.Err(err))
+		}
+		logger.Debug("Pre-stop command output", logging.Container(container.ID), "output", output)
+	}
+	err := group.dockerController.StopContainerWithOptions(ctx, container.ID, config.Signal, config.Timeout)
+	group.refreshState(container.ID)
+	return err
+}
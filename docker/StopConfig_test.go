@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContainerStopConfigLabels(t *testing.T) {
+	groupConfig := StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopCommand: "save"}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   StopConfig
+	}{
+		{
+			name:   "no labels",
+			labels: nil,
+			want:   StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name: "every label",
+			labels: map[string]string{
+				stopSignalLabel:     "SIGINT",
+				stopTimeoutLabel:    "2m",
+				preStopCommandLabel: "rcon-cli save-all",
+				preStopTimeoutLabel: "30s",
+			},
+			want: StopConfig{Signal: "SIGINT", Timeout: 2 * time.Minute, PreStopCommand: "rcon-cli save-all", PreStopTimeout: 30 * time.Second},
+		},
+		{
+			name:   "signal without prefix",
+			labels: map[string]string{stopSignalLabel: "int"},
+			want:   StopConfig{Signal: "int", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name:   "signal number",
+			labels: map[string]string{stopSignalLabel: "2"},
+			want:   StopConfig{Signal: "2", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name:   "invalid signal",
+			labels: map[string]string{stopSignalLabel: "SIGNOPE"},
+			want:   StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name:   "signal number out of range",
+			labels: map[string]string{stopSignalLabel: "99"},
+			want:   StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name:   "invalid stop timeout",
+			labels: map[string]string{stopTimeoutLabel: "soon"},
+			want:   StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name:   "invalid pre-stop timeout",
+			labels: map[string]string{preStopTimeoutLabel: "10"},
+			want:   StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopCommand: "save", PreStopTimeout: time.Minute},
+		},
+		{
+			name:   "empty pre-stop command disables the group's",
+			labels: map[string]string{preStopCommandLabel: ""},
+			want:   StopConfig{Signal: "SIGTERM", Timeout: 10 * time.Second, PreStopTimeout: time.Minute},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := NewContainerGroup("test", nil, nil)
+			group.SetStopConfig(groupConfig)
+			got := group.containerStopConfig(&Container{ID: "game", Name: "/game", Labels: test.labels})
+			if got != test.want {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetStopConfigIgnoresInvalidSignal(t *testing.T) {
+	group := NewContainerGroup("test", nil, nil)
+	group.SetStopConfig(StopConfig{Signal: "TERMINATE", Timeout: time.Second})
+	if group.stopConfig.Signal != "" {
+		t.Errorf("Invalid group signal kept: %q", group.stopConfig.Signal)
+	}
+	if group.stopConfig.Timeout != time.Second {
+		t.Errorf("Timeout changed to %s", group.stopConfig.Timeout)
+	}
+}
@@ -0,0 +1,31 @@
+package docker
+
+import "time"
+
+const defaultOperationTimeout = 30 * time.Second
+
+// Deadlines for Docker operations, 0 uses Default and a Default of 0 uses
+// 30 seconds
+type Timeouts struct {
+	Default time.Duration
+	Start   time.Duration
+	Stop    time.Duration // Extended to cover the stop timeout of the container
+	Pause   time.Duration
+	Unpause time.Duration
+	Inspect time.Duration
+	List    time.Duration
+}
+
+func (controller *DockerController) SetTimeouts(timeouts Timeouts) {
+	controller.timeouts = timeouts
+}
+
+func (timeouts Timeouts) orDefault(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	if timeouts.Default > 0 {
+		return timeouts.Default
+	}
+	return defaultOperationTimeout
+}
@@ -0,0 +1,98 @@
+package eventLog
+
+import (
+	"sync"
+	"time"
+)
+
+// Amount of events kept for GET /events
+var HistorySize = 100
+
+type Event struct {
+	Time          time.Time `json:"time"`
+	Type          string    `json:"type"`
+	Group         string    `json:"group,omitempty"`
+	ContainerId   string    `json:"containerId,omitempty"`
+	ContainerName string    `json:"containerName,omitempty"`
+	Message       string    `json:"message,omitempty"`
+}
+
+const (
+	// Timid started, after a restart the previous state of the group is unknown
+	TimidStarted    = "timid.started"
+	ContainerJoined = "container.joined"
+	ContainerLeft   = "container.left"
+	GroupStarted    = "group.started"
+	GroupPaused     = "group.paused"
+	GroupStopped    = "group.stopped"
+	// A connection arrived during the countdown to pausing or stopping
+	WakeAborted = "group.wake-abort"
+	// The idle policy was changed through the API or a hold awake expired
+	PolicyChanged = "policy.changed"
+	Error         = "error"
+)
+
+var (
+	history     []Event
+	subscribers = make(map[chan Event]struct{})
+	recorders   []func(Event)
+	mutex       sync.Mutex
+)
+
+// Record an event and pass it on to all recorders and subscribers,
+// subscribers that are not keeping up miss the event instead of blocking the
+// publisher
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	history = append(history, event)
+	if len(history) > HistorySize {
+		history = history[len(history)-HistorySize:]
+	}
+	for _, record := range recorders {
+		record(event)
+	}
+	for subscriber := range subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Recent events, oldest first
+func Recent() []Event {
+	mutex.Lock()
+	defer mutex.Unlock()
+	events := make([]Event, len(history))
+	copy(events, history)
+	return events
+}
+
+// Call record with every future event as it is published, in order. For
+// subscribers that must not miss events, like the persisted history, record
+// must not block and queue the event itself
+func AddRecorder(record func(Event)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	recorders = append(recorders, record)
+}
+
+// Receive all future events until the returned function is called
+func Subscribe() (<-chan Event, func()) {
+	subscriber := make(chan Event, 16)
+	mutex.Lock()
+	subscribers[subscriber] = struct{}{}
+	mutex.Unlock()
+	return subscriber, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if _, found := subscribers[subscriber]; found {
+			delete(subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Check the health of a running Timid through the REST API, meant to be used
+// as the HEALTHCHECK of the image since it has no curl. Exits with 1 if Timid
+// is unhealthy or the API is disabled, without it the proxy can't be checked.
+func runHealthcheck(args []string) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	ready := flags.Bool("ready", false, "Check readiness instead of liveness")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of the request")
+	flags.Parse(args)
+
+	apiEnabled, _ := apiEnabledKey.GetEnvBool()
+	if !apiEnabled {
+		fmt.Fprintln(os.Stderr, "REST API disabled, health can't be checked. Set TIMID_API_ENABLE=true or disable the health check")
+		return 1
+	}
+	apiPort, _ := apiPortKey.GetEnvIntOrFallback(80)
+
+	route := "/healthz"
+	if *ready {
+		route = "/readyz"
+	}
+	client := http.Client{Timeout: *timeout}
+	response, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", apiPort, route))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	fmt.Println(string(body))
+	if response.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,232 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fuglesteg/timid/eventLog"
+	"github.com/fuglesteg/timid/logging"
+)
+
+const (
+	KindEvent   = "event"   // A lifecycle event, see eventLog
+	KindSession = "session" // A client session that ended
+)
+
+const compactInterval = 24 * time.Hour
+
+var logger = logging.For(logging.History)
+
+// Summary of a client session, from the first to the last packet
+type Session struct {
+	Client            string    `json:"client"`
+	Group             string    `json:"group,omitempty"`
+	Started           time.Time `json:"started"`
+	Ended             time.Time `json:"ended"`
+	PacketsFromClient uint64    `json:"packetsFromClient"`
+	BytesFromClient   uint64    `json:"bytesFromClient"`
+	PacketsFromServer uint64    `json:"packetsFromServer"`
+	BytesFromServer   uint64    `json:"bytesFromServer"`
+}
+
+type Record struct {
+	Time    time.Time       `json:"time"`
+	Kind    string          `json:"kind"`
+	Event   *eventLog.Event `json:"event,omitempty"`
+	Session *Session        `json:"session,omitempty"`
+}
+
+// Lifecycle events and session summaries, appended to a JSON lines file so
+// they survive restarts. Without a file records are only kept in memory.
+type Store struct {
+	file      string
+	retention time.Duration
+	records   []Record
+	mutex     sync.RWMutex
+	// Records waiting to be written, never dropped so bursts can't lose them
+	queued      []Record
+	queueMutex  sync.Mutex
+	queueSignal chan struct{}
+}
+
+// Open the store, reading the records in file if it exists. Records older
+// than retention are dropped, 0 keeps records forever.
+func Open(file string, retention time.Duration) (*Store, error) {
+	store := &Store{
+		file:        file,
+		retention:   retention,
+		queueSignal: make(chan struct{}, 1),
+	}
+	if file == "" {
+		return store, nil
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *Store) load() error {
+	file, err := os.Open(store.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A partially written last line after a crash shouldn't lose the rest
+			logger.Warn("Skipping unreadable history record", "file", store.file, "line", line, logging.Err(err))
+			continue
+		}
+		store.records = append(store.records, record)
+	}
+	return scanner.Err()
+}
+
+// Drop records older than the retention and rewrite the file
+func (store *Store) compact() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.retention > 0 {
+		cutoff := time.Now().Add(-store.retention)
+		// Sessions are recorded when they end, records are only roughly ordered
+		kept := store.records[:0]
+		for _, record := range store.records {
+			if !record.Time.Before(cutoff) {
+				kept = append(kept, record)
+			}
+		}
+		store.records = kept
+	}
+	if store.file == "" {
+		return nil
+	}
+	temporaryFile := store.file + ".tmp"
+	file, err := os.Create(temporaryFile)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range store.records {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := errors.Join(writer.Flush(), file.Close()); err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile, store.file)
+}
+
+func (store *Store) append(record Record) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.records = append(store.records, record)
+	if store.file == "" {
+		return nil
+	}
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(store.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(bytes, '\n'))
+	return errors.Join(err, file.Close())
+}
+
+// Queue a record to be written, never blocks
+func (store *Store) queue(record Record) {
+	store.queueMutex.Lock()
+	store.queued = append(store.queued, record)
+	store.queueMutex.Unlock()
+	select {
+	case store.queueSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (store *Store) takeQueued() []Record {
+	store.queueMutex.Lock()
+	defer store.queueMutex.Unlock()
+	records := store.queued
+	store.queued = nil
+	return records
+}
+
+// Record lifecycle events and queued sessions until the program exits
+func (store *Store) Start() {
+	eventLog.AddRecorder(func(event eventLog.Event) {
+		store.queue(Record{Time: event.Time, Kind: KindEvent, Event: &event})
+	})
+	go func() {
+		compact := time.NewTicker(compactInterval)
+		defer compact.Stop()
+		for {
+			select {
+			case <-store.queueSignal:
+				for _, record := range store.takeQueued() {
+					if err := store.append(record); err != nil {
+						logger.Error("Failed to write history record", "file", store.file, logging.Err(err))
+					}
+				}
+			case <-compact.C:
+				if err := store.compact(); err != nil {
+					logger.Error("Failed to compact history", "file", store.file, logging.Err(err))
+				}
+			}
+		}
+	}()
+}
+
+// Queue a finished session to be recorded, never blocks
+func (store *Store) RecordSession(session Session) {
+	store.queue(Record{Time: session.Ended, Kind: KindSession, Session: &session})
+}
+
+// Records with a time in [from, to), in the order they were recorded. Zero
+// times leave the range open, an empty kind matches every kind.
+func (store *Store) Query(from time.Time, to time.Time, kind string) []Record {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	records := []Record{}
+	for _, record := range store.records {
+		if !from.IsZero() && record.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !record.Time.Before(to) {
+			continue
+		}
+		if kind != "" && record.Kind != kind {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func ValidKind(kind string) error {
+	switch kind {
+	case "", KindEvent, KindSession:
+		return nil
+	}
+	return fmt.Errorf("Unknown history record kind: %s", kind)
+}
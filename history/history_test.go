@@ -0,0 +1,60 @@
+package history
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fuglesteg/timid/eventLog"
+)
+
+// Far more than a subscriber of eventLog buffers, a burst must not lose any
+func TestBurstIsRecordedCompletely(t *testing.T) {
+	const burst = 200
+	file := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := Open(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Start()
+
+	start := time.Now()
+	for i := range burst {
+		eventLog.Publish(eventLog.Event{Type: eventLog.GroupStarted, Group: "test", Message: fmt.Sprint(i)})
+		store.RecordSession(Session{
+			Client:  fmt.Sprintf("192.0.2.1:%d", i),
+			Started: start,
+			Ended:   start.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); len(store.Query(time.Time{}, time.Time{}, "")) < 2*burst; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Recorded %d of %d records", len(store.Query(time.Time{}, time.Time{}, "")), 2*burst)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := store.Query(time.Time{}, time.Time{}, KindEvent)
+	if len(events) != burst {
+		t.Fatalf("Recorded %d events, want %d", len(events), burst)
+	}
+	for i, record := range events {
+		if record.Event.Message != fmt.Sprint(i) {
+			t.Fatalf("Event %d recorded as %q, out of order", i, record.Event.Message)
+		}
+	}
+
+	// Everything recorded was written to the file
+	reopened, err := Open(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions := reopened.Query(time.Time{}, time.Time{}, KindSession); len(sessions) != burst {
+		t.Errorf("File has %d sessions, want %d", len(sessions), burst)
+	}
+	if events := reopened.Query(time.Time{}, time.Time{}, KindEvent); len(events) != burst {
+		t.Errorf("File has %d events, want %d", len(events), burst)
+	}
+}
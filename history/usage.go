@@ -0,0 +1,187 @@
+package history
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/fuglesteg/timid/eventLog"
+)
+
+const dateFormat = "2006-01-02"
+
+// Usage of a group on a single day
+type Usage struct {
+	Date  string // Day in the local time zone, YYYY-MM-DD
+	Group string
+	// Time the group was running or paused, as far as the recorded transitions tell
+	Runtime time.Duration
+	Paused  time.Duration
+	// Times the group was started or unpaused
+	Wakes   int
+	Bytes   uint64
+	Clients []ClientUsage
+}
+
+// Usage of a group by a single client IP on a single day
+type ClientUsage struct {
+	Client    string
+	Sessions  int
+	Connected time.Duration
+	Bytes     uint64
+}
+
+type usageKey struct {
+	date  string
+	group string
+}
+
+type groupTimeline struct {
+	state string // Last transition event type, empty while unknown
+	since time.Time
+}
+
+// Aggregate the records in [from, to) per group and day, ordered by day and
+// group. Zero times leave the range open. Groups keep their state across
+// restarts of Timid, as containers aren't stopped when Timid exits. Time
+// before the first recorded transition of a group is not counted.
+func (store *Store) Usage(from time.Time, to time.Time) []Usage {
+	now := time.Now()
+	if to.IsZero() || to.After(now) {
+		to = now
+	}
+	records := store.Query(time.Time{}, to, "")
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	usages := make(map[usageKey]*Usage)
+	clients := make(map[usageKey]map[string]*ClientUsage)
+	usageFor := func(day time.Time, group string) *Usage {
+		key := usageKey{date: day.Local().Format(dateFormat), group: group}
+		usage, found := usages[key]
+		if !found {
+			usage = &Usage{Date: key.date, Group: group}
+			usages[key] = usage
+		}
+		return usage
+	}
+	// Split the time the group spent in a state over the days it covers
+	addTime := func(group string, state string, start time.Time, end time.Time) {
+		if state != eventLog.GroupStarted && state != eventLog.GroupPaused {
+			return
+		}
+		if !from.IsZero() && start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		for start.Before(end) {
+			dayEnd := startOfDay(start).AddDate(0, 0, 1)
+			if dayEnd.After(end) {
+				dayEnd = end
+			}
+			usage := usageFor(start, group)
+			if state == eventLog.GroupStarted {
+				usage.Runtime += dayEnd.Sub(start)
+			} else {
+				usage.Paused += dayEnd.Sub(start)
+			}
+			start = dayEnd
+		}
+	}
+	inRange := func(when time.Time) bool {
+		return (from.IsZero() || !when.Before(from)) && when.Before(to)
+	}
+
+	timelines := make(map[string]*groupTimeline)
+	for _, record := range records {
+		switch {
+		case record.Event != nil:
+			event := record.Event
+			switch event.Type {
+			case eventLog.GroupStarted, eventLog.GroupPaused, eventLog.GroupStopped:
+			default:
+				continue
+			}
+			timeline, found := timelines[event.Group]
+			if !found {
+				timeline = &groupTimeline{}
+				timelines[event.Group] = timeline
+			}
+			if timeline.state != "" {
+				addTime(event.Group, timeline.state, timeline.since, event.Time)
+			}
+			if event.Type == eventLog.GroupStarted && inRange(event.Time) {
+				usageFor(event.Time, event.Group).Wakes++
+			}
+			timeline.state = event.Type
+			timeline.since = event.Time
+		case record.Session != nil:
+			session := record.Session
+			if !inRange(session.Ended) {
+				continue
+			}
+			bytes := session.BytesFromClient + session.BytesFromServer
+			usage := usageFor(session.Ended, session.Group)
+			usage.Bytes += bytes
+			key := usageKey{date: usage.Date, group: usage.Group}
+			if clients[key] == nil {
+				clients[key] = make(map[string]*ClientUsage)
+			}
+			client := clientIP(session.Client)
+			clientUsage, found := clients[key][client]
+			if !found {
+				clientUsage = &ClientUsage{Client: client}
+				clients[key][client] = clientUsage
+			}
+			clientUsage.Sessions++
+			clientUsage.Connected += session.Ended.Sub(session.Started)
+			clientUsage.Bytes += bytes
+		}
+	}
+	for group, timeline := range timelines {
+		addTime(group, timeline.state, timeline.since, to)
+	}
+
+	result := make([]Usage, 0, len(usages))
+	for key, usage := range usages {
+		for _, clientUsage := range clients[key] {
+			usage.Clients = append(usage.Clients, *clientUsage)
+		}
+		sort.Slice(usage.Clients, func(i, j int) bool {
+			return usage.Clients[i].Client < usage.Clients[j].Client
+		})
+		result = append(result, *usage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Date != result[j].Date {
+			return result[i].Date < result[j].Date
+		}
+		return result[i].Group < result[j].Group
+	})
+	return result
+}
+
+// Clients are counted by IP, every session of a client has a new port
+func clientIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+func startOfDay(when time.Time) time.Time {
+	year, month, day := when.Local().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// Parse a date in the local time zone, or an RFC 3339 time
+func ParseTime(value string) (time.Time, error) {
+	if when, err := time.ParseInLocation(dateFormat, value, time.Local); err == nil {
+		return when, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,184 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/fuglesteg/timid/docker"
+	"github.com/fuglesteg/timid/logging"
+)
+
+// Lifecycle transitions hooks can be attached to
+const (
+	Idle      = "idle"       // No connections, the pause/stop countdown starts
+	PreStart  = "pre-start"  // Before containers are started or unpaused
+	PostStart = "post-start" // After containers are started or unpaused
+	PrePause  = "pre-pause"
+	PostPause = "post-pause"
+	PreStop   = "pre-stop"
+	PostStop  = "post-stop"
+)
+
+// Hook types
+const (
+	Command = "command" // Local command run by Timid
+	Exec    = "exec"    // Command run with docker exec in a container of the group
+	Http    = "http"    // HTTP request
+)
+
+// Failure policies
+const (
+	Continue = "continue" // Log the failure and carry on
+	Abort    = "abort"    // Skip the remaining hooks, and the transition for pre hooks
+)
+
+const defaultTimeout = 30 * time.Second
+
+var logger = logging.For(logging.Hooks)
+
+type Hook struct {
+	Name      string   `json:"name"`
+	On        string   `json:"on"`
+	Type      string   `json:"type"`
+	Command   []string `json:"command"`   // command and exec hooks
+	Container string   `json:"container"` // exec hooks, container name or compose service
+	Url       string   `json:"url"`       // http hooks
+	Method    string   `json:"method"`    // http hooks, defaults to POST
+	Body      string   `json:"body"`      // http hooks
+	Timeout   string   `json:"timeout"`   // Duration string, defaults to 30 seconds
+	OnFailure string   `json:"onFailure"` // continue or abort, defaults to continue
+
+	timeout time.Duration
+}
+
+type Runner struct {
+	hooks          []Hook
+	containerGroup *docker.ContainerGroup
+}
+
+// Read hooks from a JSON file containing a list of hooks
+func Load(file string, containerGroup *docker.ContainerGroup) (*Runner, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(bytes, &hooks); err != nil {
+		return nil, fmt.Errorf("Failed to parse hooks file %s: %w", file, err)
+	}
+	for i := range hooks {
+		if err := hooks[i].validate(); err != nil {
+			return nil, fmt.Errorf("Invalid hook %d (%s): %w", i, hooks[i].Name, err)
+		}
+	}
+	return &Runner{hooks: hooks, containerGroup: containerGroup}, nil
+}
+
+func (hook *Hook) validate() error {
+	switch hook.On {
+	case Idle, PreStart, PostStart, PrePause, PostPause, PreStop, PostStop:
+	default:
+		return fmt.Errorf("Unknown transition: %s", hook.On)
+	}
+	switch hook.Type {
+	case Command:
+		if len(hook.Command) == 0 {
+			return errors.New("Command hook without a command")
+		}
+	case Exec:
+		if len(hook.Command) == 0 || hook.Container == "" {
+			return errors.New("Exec hook needs a command and a container")
+		}
+	case Http:
+		if hook.Url == "" {
+			return errors.New("HTTP hook without an url")
+		}
+		if hook.Method == "" {
+			hook.Method = http.MethodPost
+		}
+	default:
+		return fmt.Errorf("Unknown hook type: %s", hook.Type)
+	}
+	switch hook.OnFailure {
+	case "":
+		hook.OnFailure = Continue
+	case Continue, Abort:
+	default:
+		return fmt.Errorf("Unknown failure policy: %s", hook.OnFailure)
+	}
+	hook.timeout = defaultTimeout
+	if hook.Timeout != "" {
+		timeout, err := time.ParseDuration(hook.Timeout)
+		if err != nil {
+			return err
+		}
+		hook.timeout = timeout
+	}
+	return nil
+}
+
+// Run the hooks attached to a transition in order. Returns an error if a
+// hook with the abort policy failed, the transition should then be skipped.
+// A nil runner runs nothing.
+func (runner *Runner) Run(ctx context.Context, transition string) error {
+	if runner == nil {
+		return nil
+	}
+	for _, hook := range runner.hooks {
+		if hook.On != transition {
+			continue
+		}
+		logger.Debug("Running hook", "hook", hook.Name, logging.Transition(transition))
+		err := runner.run(ctx, hook)
+		if err == nil {
+			continue
+		}
+		if hook.OnFailure == Abort {
+			return fmt.Errorf("%s hook %s failed: %w", transition, hook.Name, err)
+		}
+		logger.Error("Hook failed", "hook", hook.Name, logging.Transition(transition), logging.Err(err))
+	}
+	return nil
+}
+
+func (runner *Runner) run(ctx context.Context, hook Hook) error {
+	switch hook.Type {
+	case Command:
+		ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...).CombinedOutput()
+		logger.Debug("Hook output", "hook", hook.Name, "output", string(output))
+		return err
+	case Exec:
+		output, err := runner.containerGroup.ExecInContainer(ctx, hook.Container, hook.Command, hook.timeout)
+		logger.Debug("Hook output", "hook", hook.Name, "output", output)
+		return err
+	case Http:
+		ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+		defer cancel()
+		request, err := http.NewRequestWithContext(ctx, hook.Method, hook.Url, strings.NewReader(hook.Body))
+		if err != nil {
+			return err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return fmt.Errorf("Status %s: %s", response.Status, bytes.TrimSpace(body))
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown hook type: %s", hook.Type)
+}
@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"log/slog"
+)
+
+// Attribute keys shared by all subsystems so logs can be filtered on them
+
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+func Client(address string) slog.Attr {
+	return slog.String("client", address)
+}
+
+func Group(name string) slog.Attr {
+	return slog.String("group", name)
+}
+
+func Container(id string) slog.Attr {
+	return slog.String("container", id)
+}
+
+func ContainerName(name string) slog.Attr {
+	return slog.String("containerName", name)
+}
+
+func Transition(transition string) slog.Attr {
+	return slog.String("transition", transition)
+}
@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Level below debug, for per packet decisions like rate limiting
+const LevelTrace = slog.Level(-8)
+
+// Subsystems with their own logger, each can have its level overridden
+const (
+	Main     = "main"
+	Proxy    = "proxy"
+	Docker   = "docker"
+	Api      = "api"
+	Hooks    = "hooks"
+	Webhooks = "webhooks"
+	History  = "history"
+	Policy   = "policy"
+	// Packets traced through the API, logged at info level
+	Packets = "packets"
+)
+
+// Output format and levels of the logs
+type Config struct {
+	Level  slog.Level
+	Format string // "text" or "json"
+	// Overrides Level for the given subsystems
+	Levels map[string]slog.Level
+	Output io.Writer
+}
+
+type state struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+func (state *state) levelFor(subsystem string) slog.Level {
+	if level, found := state.levels[subsystem]; found {
+		return level
+	}
+	return state.level
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	Configure(Config{Level: slog.LevelInfo})
+}
+
+func replaceAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := attr.Value.Any().(slog.Level); ok {
+			attr.Value = slog.StringValue(LevelName(level))
+		}
+	}
+	return attr
+}
+
+// Replace the configuration, applies to all loggers including the ones
+// created before
+func Configure(config Config) error {
+	output := config.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	// Levels are filtered per subsystem, the handler itself passes everything
+	options := &slog.HandlerOptions{Level: LevelTrace, ReplaceAttr: replaceAttr}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		return fmt.Errorf("Unknown log format: %s", config.Format)
+	}
+	current.Store(&state{handler: handler, level: config.Level, levels: config.Levels})
+	slog.SetDefault(For(Main))
+	return nil
+}
+
+// Logger for a subsystem, records carry the subsystem as an attribute
+func For(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem}).With("subsystem", subsystem)
+}
+
+// Filters records by the level of its subsystem and hands them to the
+// currently configured handler
+type subsystemHandler struct {
+	subsystem string
+	// WithAttrs and WithGroup calls, replayed on the configured handler
+	wrappers []func(slog.Handler) slog.Handler
+}
+
+func (handler *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= current.Load().levelFor(handler.subsystem)
+}
+
+func (handler *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	inner := current.Load().handler
+	for _, wrap := range handler.wrappers {
+		inner = wrap(inner)
+	}
+	return inner.Handle(ctx, record)
+}
+
+func (handler *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) *subsystemHandler {
+	wrappers := make([]func(slog.Handler) slog.Handler, len(handler.wrappers), len(handler.wrappers)+1)
+	copy(wrappers, handler.wrappers)
+	return &subsystemHandler{subsystem: handler.subsystem, wrappers: append(wrappers, wrap)}
+}
+
+func (handler *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler.with(func(inner slog.Handler) slog.Handler {
+		return inner.WithAttrs(attrs)
+	})
+}
+
+func (handler *subsystemHandler) WithGroup(name string) slog.Handler {
+	return handler.with(func(inner slog.Handler) slog.Handler {
+		return inner.WithGroup(name)
+	})
+}
+
+func LevelName(level slog.Level) string {
+	if level == LevelTrace {
+		return "TRACE"
+	}
+	return level.String()
+}
+
+// Parse a level name: trace, debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	if strings.EqualFold(name, "trace") {
+		return LevelTrace, nil
+	}
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+// Parse a comma separated list of subsystem=level overrides
+func ParseLevels(list string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		subsystem, name, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("Invalid log level override, expected subsystem=level: %s", entry)
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid log level for %s: %w", subsystem, err)
+		}
+		levels[strings.TrimSpace(subsystem)] = level
+	}
+	return levels, nil
+}
+
+// Level matching the numeric verbosity of TIMID_LOG_VERBOSITY
+func LevelFromVerbosity(verbosity int) slog.Level {
+	switch {
+	case verbosity <= 0:
+		return slog.LevelError
+	case verbosity == 1:
+		return slog.LevelInfo
+	case verbosity <= 4:
+		return slog.LevelDebug
+	}
+	return LevelTrace
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fuglesteg/timid/api"
+	"github.com/fuglesteg/timid/ctl"
 	"github.com/fuglesteg/timid/docker"
 	"github.com/fuglesteg/timid/envInit"
+	"github.com/fuglesteg/timid/eventLog"
+	"github.com/fuglesteg/timid/history"
+	"github.com/fuglesteg/timid/hooks"
+	"github.com/fuglesteg/timid/policy"
 	"github.com/fuglesteg/timid/proxy"
-	"github.com/fuglesteg/timid/verboseLog"
+	"github.com/fuglesteg/timid/logging"
+	"github.com/fuglesteg/timid/webhooks"
 )
 
 // TODO: Experiment with proxy buffering packets until container starts
@@ -17,9 +28,17 @@ import (
 // TODO: Api endpoint for checking if game server is accepting connections yet
 var proxyServer *proxy.Proxy
 var dockerController *docker.DockerController
-var containerProcedureRunning = false
+// Set while a pause/stop procedure counts down or runs
+var containerProcedureRunning atomic.Bool
+// Cancels the running pause/stop procedure and waits for it to finish
+var abortContainerProcedure = func() {}
+var containerProcedureMutex sync.Mutex
 var oneMinuteDuration, _ = time.ParseDuration("1m")
 var containerGroup *docker.ContainerGroup = new(docker.ContainerGroup)
+var lifecycleHooks *hooks.Runner
+var historyStore *history.Store
+var policyStore *policy.Store
+var logger = logging.For(logging.Main)
 
 var (
 	pauseContainerKey = envInit.EnvKey("TIMID_PAUSE_CONTAINER")
@@ -40,7 +59,62 @@ var (
 	connectionTimeoutDelayKey = envInit.EnvKey("TIMID_CONNECTION_TIMEOUT_DELAY")
 	connectionTimeoutDelay    time.Duration
 
+	targetResolveIntervalKey = envInit.EnvKey("TIMID_TARGET_RESOLVE_INTERVAL")
+	targetResolveInterval    time.Duration
+
+	allowCidrsKey = envInit.EnvKey("TIMID_ALLOW_CIDRS")
+	denyCidrsKey  = envInit.EnvKey("TIMID_DENY_CIDRS")
+	accessList    *proxy.AccessList
+
+	clientPacketRateKey = envInit.EnvKey("TIMID_CLIENT_PACKET_RATE")
+	clientPacketRate    int
+
+	clientByteRateKey = envInit.EnvKey("TIMID_CLIENT_BYTE_RATE")
+	clientByteRate    int
+
+	maxSessionsKey = envInit.EnvKey("TIMID_MAX_SESSIONS")
+	maxSessions    int
+
+	banFileKey = envInit.EnvKey("TIMID_BAN_FILE")
+	banFile    string
+
+	proxyProtocolSendKey = envInit.EnvKey("TIMID_PROXY_PROTOCOL_SEND")
+	proxyProtocolSend    bool
+
+	proxyProtocolTrustedKey = envInit.EnvKey("TIMID_PROXY_PROTOCOL_TRUSTED")
+	proxyProtocolTrusted    *proxy.AccessList
+
+	transparentKey = envInit.EnvKey("TIMID_TRANSPARENT")
+	transparent    bool
+
+	groupReconcileIntervalKey = envInit.EnvKey("TIMID_GROUP_RECONCILE_INTERVAL")
+	dependencyTimeoutKey      = envInit.EnvKey("TIMID_DEPENDENCY_TIMEOUT")
+	dockerTimeoutKey          = envInit.EnvKey("TIMID_DOCKER_TIMEOUT")
+	dockerStartTimeoutKey     = envInit.EnvKey("TIMID_DOCKER_START_TIMEOUT")
+	dockerStopTimeoutKey      = envInit.EnvKey("TIMID_DOCKER_STOP_TIMEOUT")
+	dockerPauseTimeoutKey     = envInit.EnvKey("TIMID_DOCKER_PAUSE_TIMEOUT")
+	dockerUnpauseTimeoutKey   = envInit.EnvKey("TIMID_DOCKER_UNPAUSE_TIMEOUT")
+	dockerInspectTimeoutKey   = envInit.EnvKey("TIMID_DOCKER_INSPECT_TIMEOUT")
+	dockerListTimeoutKey      = envInit.EnvKey("TIMID_DOCKER_LIST_TIMEOUT")
+	stopSignalKey             = envInit.EnvKey("TIMID_STOP_SIGNAL")
+	stopTimeoutKey            = envInit.EnvKey("TIMID_STOP_TIMEOUT")
+	preStopCommandKey         = envInit.EnvKey("TIMID_PRE_STOP_COMMAND")
+	preStopTimeoutKey         = envInit.EnvKey("TIMID_PRE_STOP_TIMEOUT")
+
+	captureDirKey = envInit.EnvKey("TIMID_CAPTURE_DIR")
+
+	policyFileKey = envInit.EnvKey("TIMID_POLICY_FILE")
+
+	historyFileKey      = envInit.EnvKey("TIMID_HISTORY_FILE")
+	historyRetentionKey = envInit.EnvKey("TIMID_HISTORY_RETENTION")
+
+	hooksFileKey    = envInit.EnvKey("TIMID_HOOKS_FILE")
+	webhooksFileKey = envInit.EnvKey("TIMID_WEBHOOKS_FILE")
+
 	verbosityKey      = envInit.EnvKey("TIMID_LOG_VERBOSITY")
+	logLevelKey       = envInit.EnvKey("TIMID_LOG_LEVEL")
+	logFormatKey      = envInit.EnvKey("TIMID_LOG_FORMAT")
+	logLevelsKey      = envInit.EnvKey("TIMID_LOG_LEVELS")
 	containerNameKey  = envInit.EnvKey("TIMID_CONTAINER_NAME")
 	containerGroupKey = envInit.EnvKey("TIMID_CONTAINER_GROUP")
 
@@ -49,21 +123,90 @@ var (
 
 	apiPortKey = envInit.EnvKey("TIMID_API_PORT")
 	apiPort int
+
+	apiTokenKey = envInit.EnvKey("TIMID_API_TOKEN")
+	apiToken string
 )
 
 
 func main() {
-	verboseLog.Vlogf(1, "Starting...")
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctl.Run(os.Args[2:]))
+	}
+	initLogging()
+	logger.Info("Starting...")
 	initDockerController()
 	initEnvVariables()
 
-	verboseLog.Vlogf(1, "Proxy port = %d, Target address = %s\n",
-		proxyPort, targetAddress)
+	logger.Info("Configured proxy", "port", proxyPort, "target", targetAddress)
 
 	var err error
 	proxyServer, err = proxy.NewProxy(proxyPort, targetAddress, connectionTimeoutDelay)
+	if err != nil {
+		logger.Error("Failed to set up proxy", logging.Err(err))
+	}
+
+	if hooksFile, err := hooksFileKey.GetEnvString(); err == nil {
+		lifecycleHooks, err = hooks.Load(hooksFile, containerGroup)
+		if err != nil {
+			panic(fmt.Errorf("Failed to load hooks: %s", err))
+		}
+	}
 
-	verboseLog.Checkreport(1, err)
+	policyStore = initPolicy()
+	proxyServer.SetConnectionTimeoutDelay(policyStore.Get().ConnectionTimeoutDelay)
+	policyStore.SetListener(func(old policy.Policy, new policy.Policy, by string) {
+		changes := policy.Diff(old, new)
+		logger.Info("Policy changed", logging.Group(containerGroup.Name), "by", by, "changes", changes)
+		publishGroupEvent(eventLog.PolicyChanged, fmt.Sprintf("Changed by %s: %s", by, changes))
+		proxyServer.SetConnectionTimeoutDelay(new.ConnectionTimeoutDelay)
+	})
+
+	historyStore = initHistory()
+	proxyServer.SetSessionListener(func(connection proxy.ConnectionInfo) {
+		historyStore.RecordSession(history.Session{
+			Client:            connection.ClientAddr,
+			Group:             containerGroup.Name,
+			Started:           connection.Created,
+			Ended:             connection.LastUsed,
+			PacketsFromClient: connection.PacketsFromClient,
+			BytesFromClient:   connection.BytesFromClient,
+			PacketsFromServer: connection.PacketsFromServer,
+			BytesFromServer:   connection.BytesFromServer,
+		})
+	})
+
+	if webhooksFile, err := webhooksFileKey.GetEnvString(); err == nil {
+		dispatcher, err := webhooks.Load(webhooksFile)
+		if err != nil {
+			panic(fmt.Errorf("Failed to load webhooks: %s", err))
+		}
+		dispatcher.Start()
+	}
+
+	proxyServer.SetResolveInterval(targetResolveInterval)
+	proxyServer.SetAccessList(accessList)
+	proxyServer.SetClientRateLimit(clientPacketRate, clientByteRate)
+	proxyServer.SetMaxSessions(maxSessions)
+	proxyServer.SetSendProxyHeader(proxyProtocolSend)
+	if transparent {
+		err = proxyServer.SetTransparent(transparent)
+		if err != nil {
+			panic(fmt.Errorf("Failed to enable transparent proxy mode: %s", err))
+		}
+	}
+	proxyServer.SetProxyHeaderTrusted(proxyProtocolTrusted)
+	if captureDir, err := captureDirKey.GetEnvString(); err == nil {
+		proxyServer.SetCaptureDir(captureDir)
+	}
+	if banFile != "" {
+		if err := proxyServer.SetBanFile(banFile); err != nil {
+			logger.Error("Failed to load bans", "file", banFile, logging.Err(err))
+		}
+	}
 
 	if dockerController != nil {
 		go func() {
@@ -71,6 +214,7 @@ func main() {
 				L: for {
 					select {
 					case <- proxyServer.OnNewConnection:
+						stopContainerProcedure()
 						startContainers()
 						break L
 					case <- time.After(5 * time.Second):
@@ -80,63 +224,178 @@ func main() {
 				}
 			}
 		}()
+	} else {
+		// Nothing reacts to new connections, keep the proxy from blocking
+		go func() {
+			for range proxyServer.OnNewConnection {
+			}
+		}()
 	}
 
 	if apiEnabled {
 		api := api.Api {
 			ProxyServer: proxyServer,
 			ContainerGroup: containerGroup,
+			History: historyStore,
+			Token: apiToken,
+			Policy: policyStore,
 		}
 		api.Init(apiPort)
 	}
 
+	publishGroupEvent(eventLog.TimidStarted, "Timid started")
 	proxyServer.RunProxy()
 }
 
+// Starts out with the policy from the environment, falls back to it if the
+// policy file can't be used
+func initPolicy() *policy.Store {
+	initial := policy.Policy{
+		ContainerShutdownDelay: containerShutdownDelay,
+		PauseContainer:         pauseContainer,
+		PauseDuration:          pauseDuration,
+		ConnectionTimeoutDelay: connectionTimeoutDelay,
+	}
+	file, err := policyFileKey.GetEnvString()
+	if err != nil {
+		logger.Debug("Policy changes will not be persisted", logging.Err(err))
+	}
+	store, err := policy.NewStore(initial, file)
+	if err != nil {
+		logger.Error("Failed to load policy, using the environment", "file", file, logging.Err(err))
+		store, err = policy.NewStore(initial, "")
+		if err != nil {
+			panic(fmt.Errorf("Invalid policy: %s", err))
+		}
+	}
+	return store
+}
+
+// Falls back to keeping history in memory if the file can't be used
+func initHistory() *history.Store {
+	retention, err := historyRetentionKey.GetEnvDurationOrFallback(30 * 24 * time.Hour)
+	if err != nil {
+		logger.Debug("History retention not set", logging.Err(err))
+	}
+	file, err := historyFileKey.GetEnvString()
+	if err != nil {
+		logger.Debug("History will not be persisted", logging.Err(err))
+	}
+	store, err := history.Open(file, retention)
+	if err != nil {
+		logger.Error("Failed to open history, keeping it in memory", "file", file, logging.Err(err))
+		store, _ = history.Open("", retention)
+	}
+	store.Start()
+	return store
+}
+
 func initDockerController() {
 	containerName, containerErr := containerNameKey.GetEnvString()
 	containerGroupName, groupErr := containerGroupKey.GetEnvString()
 	if containerErr != nil && groupErr != nil {
-		verboseLog.Checkreport(1, errors.New("Docker functionality disabled:"))
-		groupErr = fmt.Errorf("Docker group functionality could not be initialized: %s:", groupErr)
-		containerErr = fmt.Errorf("Docker container functionality could not be initialized %s:", containerErr)
-		verboseLog.Checkreport(1, groupErr)
-		verboseLog.Checkreport(1, containerErr)
+		logger.Error("Docker functionality disabled", "groupError", groupErr, "containerError", containerErr)
 		return
 	}
-	dockerController = docker.NewDockerController()
-	var err error
+	controller, err := docker.NewDockerController()
+	if err != nil {
+		logger.Error("Docker functionality disabled", logging.Err(err))
+		return
+	}
+	dockerController = controller
+	dockerController.SetTimeouts(docker.Timeouts{
+		Default: dockerTimeout(dockerTimeoutKey),
+		Start:   dockerTimeout(dockerStartTimeoutKey),
+		Stop:    dockerTimeout(dockerStopTimeoutKey),
+		Pause:   dockerTimeout(dockerPauseTimeoutKey),
+		Unpause: dockerTimeout(dockerUnpauseTimeoutKey),
+		Inspect: dockerTimeout(dockerInspectTimeoutKey),
+		List:    dockerTimeout(dockerListTimeoutKey),
+	})
+	// The containers might not exist yet, they are discovered by Watch
 	if containerName != "" {
-		container, err := dockerController.NewContainer(containerName)
-		containerGroup = docker.NewContainerGroup(containerName, []*docker.Container{container}, dockerController)
-		if err != nil {
-			panic(fmt.Errorf("Failed to initialize Docker functionality: %s", err))
-		}
+		containerGroup = dockerController.NewSingleContainerGroup(containerName)
 	} else {
-		containerGroup, err = dockerController.NewContainerGroup(containerGroupName)
-		if err != nil {
-			panic(fmt.Errorf("Failed to initialize Docker functionality: %s", err))
-		}
+		containerGroup = dockerController.NewContainerGroup(containerGroupName)
 	}
 
+	groupReconcileInterval, err := groupReconcileIntervalKey.GetEnvDurationOrFallback(oneMinuteDuration)
+	if err != nil {
+		logger.Debug("Group reconcile interval not set", logging.Err(err))
+	}
+	containerGroup.Watch(groupReconcileInterval)
+
+	dependencyTimeout, err := dependencyTimeoutKey.GetEnvDurationOrFallback(2 * time.Minute)
+	if err != nil {
+		logger.Debug("Dependency timeout not set", logging.Err(err))
+	}
+	containerGroup.SetDependencyTimeout(dependencyTimeout)
+
+	var stopConfig docker.StopConfig
+	stopConfig.Signal, _ = stopSignalKey.GetEnvStringOrFallback("")
+	stopConfig.PreStopCommand, _ = preStopCommandKey.GetEnvStringOrFallback("")
+	stopConfig.Timeout, err = stopTimeoutKey.GetEnvDurationOrFallback(0)
+	if err != nil {
+		logger.Debug("Stop timeout not set, using Docker's default", logging.Err(err))
+	}
+	stopConfig.PreStopTimeout, err = preStopTimeoutKey.GetEnvDurationOrFallback(oneMinuteDuration)
+	if err != nil {
+		logger.Debug("Pre-stop command timeout not set", logging.Err(err))
+	}
+	containerGroup.SetStopConfig(stopConfig)
+
 	containerShutdownDelay, err = containerShutdownDelayKey.GetEnvDurationOrFallback(oneMinuteDuration)
 	if err != nil {
-		verboseLog.Checkreport(4, fmt.Errorf("Container shutdown delay not set: %s", err))
+		logger.Debug("Container shutdown delay not set", logging.Err(err))
 	}
 
 	pauseContainer, err = pauseContainerKey.GetEnvBoolOrFallback(false)
 	if err != nil {
-		verboseLog.Checkreport(4, fmt.Errorf("Docker controller will never pause a container: %s", err))
+		logger.Debug("Docker controller will never pause a container", logging.Err(err))
 	}
 
 	if pauseContainer {
 		pauseDuration, err = pauseDurationKey.GetEnvDuration()
 		if err != nil {
-			verboseLog.Checkreport(4, fmt.Errorf("Containers will never be stopped %w", err))
+			logger.Debug("Containers will never be stopped", logging.Err(err))
 		}
 	}
 }
 
+// TIMID_LOG_LEVEL takes precedence over the older numeric TIMID_LOG_VERBOSITY
+func initLogging() {
+	var config logging.Config
+	config.Level = slog.LevelInfo
+	if levelName, err := logLevelKey.GetEnvString(); err == nil {
+		config.Level, err = logging.ParseLevel(levelName)
+		if err != nil {
+			panic(fmt.Errorf("Failed to parse log level: %s", err))
+		}
+	} else if verbosity, err := verbosityKey.GetEnvInt(); err == nil {
+		config.Level = logging.LevelFromVerbosity(verbosity)
+	}
+	levels, _ := logLevelsKey.GetEnvStringOrFallback("")
+	var err error
+	config.Levels, err = logging.ParseLevels(levels)
+	if err != nil {
+		panic(fmt.Errorf("Failed to parse log level overrides: %s", err))
+	}
+	config.Format, _ = logFormatKey.GetEnvStringOrFallback("text")
+	if err := logging.Configure(config); err != nil {
+		panic(fmt.Errorf("Failed to configure logging: %s", err))
+	}
+	logger.Info("Logging configured", "level", logging.LevelName(config.Level), "format", config.Format)
+}
+
+// Unset timeouts fall back to TIMID_DOCKER_TIMEOUT
+func dockerTimeout(key envInit.EnvKey) time.Duration {
+	timeout, err := key.GetEnvDurationOrFallback(0)
+	if err != nil {
+		logger.Debug("Docker timeout not set", "key", string(key), logging.Err(err))
+	}
+	return timeout
+}
+
 func initEnvVariables() {
 	var err error
 	proxyPort, err = proxyPortKey.GetEnvInt()
@@ -144,97 +403,289 @@ func initEnvVariables() {
 	if err != nil {
 		panic(fmt.Errorf("Failed to set proxy target address and/or listening port: %s", err))
 	}
-	verboseLog.Verbosity, err = verbosityKey.GetEnvIntOrFallback(1)
+	connectionTimeoutDelay, err = connectionTimeoutDelayKey.GetEnvDurationOrFallback(time.Duration(5 * time.Second))
 	if err != nil {
-		verboseLog.Checkreport(4, fmt.Errorf("Logging verbosity not set: %w", err))
+		logger.Debug("Proxy connection timeout delay not set", logging.Err(err))
 	}
-	fmt.Printf("Logging verbosity: %d \n", verboseLog.Verbosity)
-	connectionTimeoutDelay, err = connectionTimeoutDelayKey.GetEnvDurationOrFallback(time.Duration(5 * time.Second))
+
+	targetResolveInterval, err = targetResolveIntervalKey.GetEnvDurationOrFallback(30 * time.Second)
+	if err != nil {
+		logger.Debug("Target resolve interval not set", logging.Err(err))
+	}
+
+	allowCidrs, _ := allowCidrsKey.GetEnvStringOrFallback("")
+	denyCidrs, _ := denyCidrsKey.GetEnvStringOrFallback("")
+	accessList, err = proxy.ParseAccessList(allowCidrs, denyCidrs)
+	if err != nil {
+		panic(fmt.Errorf("Failed to parse client access lists: %s", err))
+	}
+
+	clientPacketRate, err = clientPacketRateKey.GetEnvIntOrFallback(0)
+	if err != nil {
+		logger.Debug("Client packet rate limit not set", logging.Err(err))
+	}
+
+	clientByteRate, err = clientByteRateKey.GetEnvIntOrFallback(0)
+	if err != nil {
+		logger.Debug("Client byte rate limit not set", logging.Err(err))
+	}
+
+	maxSessions, err = maxSessionsKey.GetEnvIntOrFallback(0)
+	if err != nil {
+		logger.Debug("Session limit not set", logging.Err(err))
+	}
+
+	banFile, err = banFileKey.GetEnvString()
 	if err != nil {
-		verboseLog.Checkreport(4, fmt.Errorf("Proxy connection timeout delay not set: %w", err))
+		logger.Debug("Bans will not be persisted", logging.Err(err))
+	}
+
+	proxyProtocolSend, err = proxyProtocolSendKey.GetEnvBoolOrFallback(false)
+	if err != nil {
+		logger.Debug("PROXY protocol headers will not be sent", logging.Err(err))
+	}
+
+	transparent, err = transparentKey.GetEnvBoolOrFallback(false)
+	if err != nil {
+		logger.Debug("Transparent proxy mode not enabled", logging.Err(err))
+	}
+
+	trustedProxies, err := proxyProtocolTrustedKey.GetEnvString()
+	if err != nil {
+		logger.Debug("PROXY protocol headers will not be accepted", logging.Err(err))
+	} else {
+		proxyProtocolTrusted, err = proxy.ParseAccessList(trustedProxies, "")
+		if err != nil {
+			panic(fmt.Errorf("Failed to parse trusted PROXY protocol addresses: %s", err))
+		}
 	}
 
 	apiPort, err = apiPortKey.GetEnvIntOrFallback(80)
 	if err != nil {
-		verboseLog.Checkreport(1, fmt.Errorf("Could not configure port for API: %w", err))
+		logger.Error("Could not configure port for API", logging.Err(err))
 	}
 	
 	apiEnabled, err = apiEnabledKey.GetEnvBool()
 	if err != nil {
-		verboseLog.Checkreport(4, fmt.Errorf("Api not enabled: %w", err))
+		logger.Debug("Api not enabled", logging.Err(err))
+	}
+
+	apiToken, err = apiTokenKey.GetEnvString()
+	if apiEnabled && err != nil {
+		logger.Warn("No API token set, anyone reaching the API can change the state of the group", logging.Err(err))
 	}
 }
 
 func startContainers() {
-	if containerGroup.AnyContainerIsPaused() {
-		verboseLog.Vlogf(1, "Unpausing containers")
-		containerGroup.Unpause()
+	if !containerGroup.Discovered() {
+		logger.Debug("Not starting containers", logging.Group(containerGroup.Name), logging.Err(docker.ErrGroupNotDiscovered))
+		return
+	}
+	isPaused := containerGroup.AnyContainerIsPaused()
+	isStopped := containerGroup.AnyContainerIsStopped()
+	if isPaused || isStopped {
+		if err := lifecycleHooks.Run(context.Background(), hooks.PreStart); err != nil {
+			reportError(fmt.Errorf("Not starting containers: %w", err))
+			return
+		}
+	}
+	var err error
+	if isPaused {
+		logger.Info("Unpausing containers", logging.Group(containerGroup.Name), logging.Transition("unpause"))
+		err = containerGroup.Unpause(context.Background())
+		if err == nil {
+			// Paused containers count as stopped, only start those still
+			// stopped so a paused group skips the dependency waits
+			isStopped = containerGroup.AnyContainerIsStopped()
+		}
 	}
-	if containerGroup.AnyContainerIsStopped() {
-		verboseLog.Vlogf(1, "Starting containers")
-		containerGroup.Start()
+	if isStopped {
+		logger.Info("Starting containers", logging.Group(containerGroup.Name), logging.Transition("start"))
+		err = errors.Join(err, containerGroup.Start(context.Background()))
+	}
+	if err != nil {
+		reportError(fmt.Errorf("Failed to start containers: %w", err))
+	} else if isPaused || isStopped {
+		publishGroupEvent(eventLog.GroupStarted, "Containers started")
+	}
+	if isPaused || isStopped {
+		reportError(lifecycleHooks.Run(context.Background(), hooks.PostStart))
+	}
+	// Containers might have been recreated with a new address
+	if err := proxyServer.ResolveTarget(); err != nil {
+		logger.Warn("Failed to resolve target", "target", targetAddress, logging.Err(err))
 	}
 }
 
 func shutdownContainerIfNoConnections(proxy *proxy.Proxy) {
-	if containerProcedureRunning ||
+	if containerProcedureRunning.Load() ||
 		proxy.GetConnectionsAmount() > 0 ||
 		containerGroup.AllContainersAreStopped() || 
 		containerGroup.AllContainersArePaused() {
 		return
 	}
 
-	if pauseContainer {
-		pauseContainerProcedure(containerShutdownDelay)
+	// Held awake, there is no countdown for the idle hooks to announce
+	currentPolicy := policyStore.Get()
+	if currentPolicy.HoldingAwake() {
+		return
+	}
+	// Idle hooks don't block reacting to new connections
+	go func() {
+		reportError(lifecycleHooks.Run(context.Background(), hooks.Idle))
+	}()
+	if currentPolicy.PauseContainer {
+		pauseContainerProcedure(currentPolicy.ContainerShutdownDelay)
 	} else {
-		shutdownContainerProcedure(containerShutdownDelay)
+		shutdownContainerProcedure(currentPolicy.ContainerShutdownDelay)
 	}
 }
 
 func pauseContainerProcedure(delay time.Duration) {
-	verboseLog.Vlogf(1, "Pausing containers in group %s, after delay of %s",
-		containerGroup.Name,
-		containerShutdownDelay.String())
-	containerProcedure(func() {
-		containerGroup.Pause()
-		verboseLog.Vlogf(1, "Containers in group %s paused", containerGroup.Name)
-		if pauseDuration != 0 {
-			containerProcedureRunning = false
-			shutdownContainerProcedure(pauseDuration)
+	logger.Info("Pausing containers after delay", logging.Group(containerGroup.Name),
+		logging.Transition("pause"), "delay", delay.String())
+	containerProcedure(func(ctx context.Context) {
+		if heldAwake(logging.Transition("pause")) {
+			return
+		}
+		if err := lifecycleHooks.Run(ctx, hooks.PrePause); err != nil {
+			reportError(fmt.Errorf("Not pausing containers: %w", err))
+			return
+		}
+		// A pause in progress completes even if a connection arrives, the
+		// containers are unpaused once the procedure returned
+		err := containerGroup.Pause(ctx)
+		switch {
+		case err == nil:
+			logger.Info("Containers paused", logging.Group(containerGroup.Name), logging.Transition("pause"))
+			publishGroupEvent(eventLog.GroupPaused, "Containers paused")
+		case ctx.Err() != nil:
+			logger.Info("Connection detected, aborting pause of containers", logging.Group(containerGroup.Name),
+				logging.Transition("pause"))
+			publishGroupEvent(eventLog.WakeAborted, "Connection detected, aborting pause of containers")
+			return
+		default:
+			reportError(fmt.Errorf("Failed to pause containers: %w", err))
+		}
+		reportError(lifecycleHooks.Run(context.WithoutCancel(ctx), hooks.PostPause))
+		if ctx.Err() != nil {
+			// Woken up, no countdown to stopping
+			return
+		}
+		// The countdown to stopping is part of the same procedure, so a
+		// connection arriving during it aborts it like any other
+		if stopDelay := policyStore.Get().PauseDuration; stopDelay != 0 {
+			logger.Info("Stopping containers after delay", logging.Group(containerGroup.Name),
+				logging.Transition("stop"), "delay", stopDelay.String())
+			if procedureDelay(ctx, stopDelay) {
+				stopContainers(ctx)
+			}
 		}
-		return
 	}, delay)
 }
 
 func shutdownContainerProcedure(delay time.Duration) {
-	verboseLog.Vlogf(1, "Stopping containers in group %s, after delay of %s",
-		containerGroup.Name,
-		delay.String())
-	containerProcedure(func() {
-		containerGroup.Stop()
-		verboseLog.Vlogf(1, "Containers in group %s stopped", containerGroup.Name)
+	logger.Info("Stopping containers after delay", logging.Group(containerGroup.Name),
+		logging.Transition("stop"), "delay", delay.String())
+	containerProcedure(stopContainers, delay)
+}
+
+func stopContainers(ctx context.Context) {
+	if heldAwake(logging.Transition("stop")) {
 		return
-	}, delay)
+	}
+	if err := lifecycleHooks.Run(ctx, hooks.PreStop); err != nil {
+		reportError(fmt.Errorf("Not stopping containers: %w", err))
+		return
+	}
+	// A stop in progress completes even if a connection arrives, the
+	// containers are started again once the procedure returned
+	err := containerGroup.Stop(ctx)
+	switch {
+	case err == nil:
+		logger.Info("Containers stopped", logging.Group(containerGroup.Name), logging.Transition("stop"))
+		publishGroupEvent(eventLog.GroupStopped, "Containers stopped")
+	case ctx.Err() != nil:
+		logger.Info("Connection detected, aborting stop of containers", logging.Group(containerGroup.Name),
+			logging.Transition("stop"))
+		publishGroupEvent(eventLog.WakeAborted, "Connection detected, aborting stop of containers")
+		return
+	default:
+		reportError(fmt.Errorf("Failed to stop containers: %w", err))
+	}
+	reportError(lifecycleHooks.Run(context.WithoutCancel(ctx), hooks.PostStop))
+}
+
+// Whether a hold awake was set while counting down to pausing or stopping
+func heldAwake(transition slog.Attr) bool {
+	currentPolicy := policyStore.Get()
+	if !currentPolicy.HoldingAwake() {
+		return false
+	}
+	logger.Info("Held awake, containers keep running", logging.Group(containerGroup.Name), transition,
+		"until", currentPolicy.HoldAwakeUntil, "reason", currentPolicy.HoldAwakeReason)
+	return true
 }
 
-func containerProcedure(procedure func(), delay time.Duration) {
-	if containerProcedureRunning {
+// Run procedure after delay unless aborted by stopContainerProcedure first.
+// Only the main loop reacts to new connections, it aborts the procedure before
+// starting the containers again.
+func containerProcedure(procedure func(ctx context.Context), delay time.Duration) {
+	if !containerProcedureRunning.CompareAndSwap(false, true) {
 		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	containerProcedureMutex.Lock()
+	abortContainerProcedure = func() {
+		cancel()
+		<-done
+	}
+	containerProcedureMutex.Unlock()
 	go func() {
-		containerProcedureRunning = true
-		defer func() { containerProcedureRunning = false }()
-		for {
-			select {
-			case <-proxyServer.OnNewConnection: {
-					verboseLog.Vlogf(1, "Connection detected, aborting pause/shutdown procedure")
-					return
-				}
-			case <-time.After(delay): {
-					procedure()
-					return
-				}
-			}
+		defer containerProcedureRunning.Store(false)
+		defer close(done)
+		defer cancel()
+		if procedureDelay(ctx, delay) {
+			procedure(ctx)
 		}
 	}()
 }
+
+// Wait for delay, false if the procedure was aborted first
+func procedureDelay(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		logger.Info("Connection detected, aborting pause/shutdown procedure", logging.Group(containerGroup.Name))
+		publishGroupEvent(eventLog.WakeAborted, "Connection detected, aborting pause/shutdown procedure")
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// Abort a running pause/stop procedure, containers not paused or stopped yet
+// are skipped. Waits for a pause or stop in progress to complete so the
+// containers can be started again right after.
+func stopContainerProcedure() {
+	containerProcedureMutex.Lock()
+	abort := abortContainerProcedure
+	containerProcedureMutex.Unlock()
+	abort()
+}
+
+func publishGroupEvent(eventType string, message string) {
+	eventLog.Publish(eventLog.Event{
+		Type:    eventType,
+		Group:   containerGroup.Name,
+		Message: message,
+	})
+}
+
+// Log the error and publish it as an event
+func reportError(err error) {
+	if err != nil {
+		logger.Error("Group operation failed", logging.Group(containerGroup.Name), logging.Err(err))
+		publishGroupEvent(eventLog.Error, err.Error())
+	}
+}
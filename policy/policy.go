@@ -0,0 +1,258 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuglesteg/timid/logging"
+)
+
+var logger = logging.For(logging.Policy)
+
+// When idle containers are paused or stopped, and when connections are idle
+type Policy struct {
+	// Time without connections before containers are paused or stopped
+	ContainerShutdownDelay time.Duration
+	// Pause containers instead of stopping them
+	PauseContainer bool
+	// Time paused containers are stopped after, never if 0
+	PauseDuration time.Duration
+	// Time a connection must be unused to be considered disconnected
+	ConnectionTimeoutDelay time.Duration
+	// Containers are not paused or stopped before this time, no hold if zero
+	HoldAwakeUntil  time.Time
+	HoldAwakeReason string
+}
+
+func (policy Policy) HoldingAwake() bool {
+	return time.Now().Before(policy.HoldAwakeUntil)
+}
+
+func (policy Policy) validate() error {
+	switch {
+	case policy.ContainerShutdownDelay < 0:
+		return fmt.Errorf("Container shutdown delay can't be negative: %s", policy.ContainerShutdownDelay)
+	case policy.PauseDuration < 0:
+		return fmt.Errorf("Pause duration can't be negative: %s", policy.PauseDuration)
+	case policy.ConnectionTimeoutDelay <= 0:
+		return fmt.Errorf("Connection timeout delay must be positive: %s", policy.ConnectionTimeoutDelay)
+	}
+	return nil
+}
+
+// Changes to a policy, nil fields are left as they are
+type Patch struct {
+	ContainerShutdownDelay *time.Duration
+	PauseContainer         *bool
+	PauseDuration          *time.Duration
+	ConnectionTimeoutDelay *time.Duration
+	// The zero time removes the hold
+	HoldAwakeUntil  *time.Time
+	HoldAwakeReason *string
+}
+
+func (policy Policy) apply(patch Patch) (Policy, error) {
+	if patch.ContainerShutdownDelay != nil {
+		policy.ContainerShutdownDelay = *patch.ContainerShutdownDelay
+	}
+	if patch.PauseContainer != nil {
+		policy.PauseContainer = *patch.PauseContainer
+	}
+	if patch.PauseDuration != nil {
+		policy.PauseDuration = *patch.PauseDuration
+	}
+	if patch.ConnectionTimeoutDelay != nil {
+		policy.ConnectionTimeoutDelay = *patch.ConnectionTimeoutDelay
+	}
+	if patch.HoldAwakeUntil != nil {
+		if !patch.HoldAwakeUntil.IsZero() && !time.Now().Before(*patch.HoldAwakeUntil) {
+			return policy, fmt.Errorf("Hold awake time is in the past: %s", patch.HoldAwakeUntil.Format(time.RFC3339))
+		}
+		policy.HoldAwakeUntil = *patch.HoldAwakeUntil
+		policy.HoldAwakeReason = ""
+	}
+	if patch.HoldAwakeReason != nil {
+		policy.HoldAwakeReason = *patch.HoldAwakeReason
+	}
+	if policy.HoldAwakeUntil.IsZero() && policy.HoldAwakeReason != "" {
+		return policy, errors.New("Hold awake reason given without a hold awake time")
+	}
+	return policy, policy.validate()
+}
+
+// Describe what changed between two policies, for the audit trail
+func Diff(old Policy, new Policy) string {
+	var changes []string
+	describe := func(name string, old any, new any) {
+		if old != new {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", name, old, new))
+		}
+	}
+	describeTime := func(when time.Time) string {
+		if when.IsZero() {
+			return "none"
+		}
+		return when.Format(time.RFC3339)
+	}
+	describe("containerShutdownDelay", old.ContainerShutdownDelay, new.ContainerShutdownDelay)
+	describe("pauseContainer", old.PauseContainer, new.PauseContainer)
+	describe("pauseDuration", old.PauseDuration, new.PauseDuration)
+	describe("connectionTimeoutDelay", old.ConnectionTimeoutDelay, new.ConnectionTimeoutDelay)
+	describe("holdAwakeUntil", describeTime(old.HoldAwakeUntil), describeTime(new.HoldAwakeUntil))
+	describe("holdAwakeReason", fmt.Sprintf("%q", old.HoldAwakeReason), fmt.Sprintf("%q", new.HoldAwakeReason))
+	return strings.Join(changes, ", ")
+}
+
+// Called after the policy changed, by is who changed it
+type Listener func(old Policy, new Policy, by string)
+
+// Policy that can be changed at runtime, changes are written to a file if
+// one is given so they survive restarts
+type Store struct {
+	policy   Policy
+	file     string
+	listener Listener
+	mutex    sync.Mutex
+}
+
+// Policy file contents, durations are duration strings
+type stored struct {
+	ContainerShutdownDelay string    `json:"containerShutdownDelay"`
+	PauseContainer         bool      `json:"pauseContainer"`
+	PauseDuration          string    `json:"pauseDuration"`
+	ConnectionTimeoutDelay string    `json:"connectionTimeoutDelay"`
+	HoldAwakeUntil         time.Time `json:"holdAwakeUntil,omitempty"`
+	HoldAwakeReason        string    `json:"holdAwakeReason,omitempty"`
+}
+
+// Store starting out with the policy, a policy saved to file replaces it
+func NewStore(policy Policy, file string) (*Store, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	store := &Store{policy: policy, file: file}
+	if file == "" {
+		return store, nil
+	}
+	saved, err := load(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load policy from %s: %w", file, err)
+	}
+	if err := saved.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid policy in %s: %w", file, err)
+	}
+	logger.Info("Using policy changed through the API", "file", file, "changes", Diff(policy, saved))
+	store.policy = saved
+	return store, nil
+}
+
+func load(file string) (Policy, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return Policy{}, err
+	}
+	var saved stored
+	if err := json.Unmarshal(bytes, &saved); err != nil {
+		return Policy{}, err
+	}
+	policy := Policy{
+		PauseContainer:  saved.PauseContainer,
+		HoldAwakeUntil:  saved.HoldAwakeUntil,
+		HoldAwakeReason: saved.HoldAwakeReason,
+	}
+	for _, duration := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{saved.ContainerShutdownDelay, &policy.ContainerShutdownDelay},
+		{saved.PauseDuration, &policy.PauseDuration},
+		{saved.ConnectionTimeoutDelay, &policy.ConnectionTimeoutDelay},
+	} {
+		if *duration.target, err = time.ParseDuration(duration.value); err != nil {
+			return Policy{}, err
+		}
+	}
+	return policy, nil
+}
+
+// Must be called with the store locked
+func (store *Store) save() error {
+	if store.file == "" {
+		return nil
+	}
+	policy := store.policy
+	bytes, err := json.MarshalIndent(stored{
+		ContainerShutdownDelay: policy.ContainerShutdownDelay.String(),
+		PauseContainer:         policy.PauseContainer,
+		PauseDuration:          policy.PauseDuration.String(),
+		ConnectionTimeoutDelay: policy.ConnectionTimeoutDelay.String(),
+		HoldAwakeUntil:         policy.HoldAwakeUntil,
+		HoldAwakeReason:        policy.HoldAwakeReason,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	temporaryFile := store.file + ".tmp"
+	if err := os.WriteFile(temporaryFile, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile, store.file)
+}
+
+// Be notified of every change, including a hold awake expiring
+func (store *Store) SetListener(listener Listener) {
+	store.listener = listener
+}
+
+// The current policy, an expired hold awake is removed
+func (store *Store) Get() Policy {
+	store.mutex.Lock()
+	old := store.policy
+	if old.HoldAwakeUntil.IsZero() || old.HoldingAwake() {
+		store.mutex.Unlock()
+		return old
+	}
+	store.policy.HoldAwakeUntil = time.Time{}
+	store.policy.HoldAwakeReason = ""
+	if err := store.save(); err != nil {
+		logger.Error("Failed to save policy", "file", store.file, logging.Err(err))
+	}
+	policy := store.policy
+	store.mutex.Unlock()
+	store.notify(old, policy, "expiry")
+	return policy
+}
+
+// Validate and apply the changes, by is who made them
+func (store *Store) Update(patch Patch, by string) (Policy, error) {
+	store.mutex.Lock()
+	old := store.policy
+	policy, err := old.apply(patch)
+	if err != nil {
+		store.mutex.Unlock()
+		return old, err
+	}
+	store.policy = policy
+	err = store.save()
+	store.mutex.Unlock()
+	if err != nil {
+		// The change applies until Timid restarts
+		logger.Error("Failed to save policy", "file", store.file, logging.Err(err))
+	}
+	store.notify(old, policy, by)
+	return policy, nil
+}
+
+func (store *Store) notify(old Policy, new Policy, by string) {
+	if store.listener != nil && old != new {
+		store.listener(old, new, by)
+	}
+}
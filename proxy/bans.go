@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client address that is not allowed to use the proxy
+type Ban struct {
+	Address string     `json:"address"`
+	Reason  string     `json:"reason,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"` // nil if the ban is permanent
+}
+
+func (ban Ban) expired() bool {
+	return ban.Expires != nil && time.Now().After(*ban.Expires)
+}
+
+// Bans keyed by IP address, optionally persisted to a JSON file
+type banList struct {
+	bans  map[string]Ban
+	file  string
+	mutex sync.Mutex
+}
+
+func newBanList() *banList {
+	return &banList{bans: make(map[string]Ban)}
+}
+
+// Accept both plain IP addresses and host:port client addresses
+func normalizeBanAddress(address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		address = host
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid ban address: %s", address)
+	}
+	return ip.String(), nil
+}
+
+// Load bans from file and persist all future changes to it
+func (list *banList) load(file string) error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.file = file
+	bytes, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(bytes, &bans); err != nil {
+		return fmt.Errorf("Failed to read bans from %s: %w", file, err)
+	}
+	for _, ban := range bans {
+		if !ban.expired() {
+			list.bans[ban.Address] = ban
+		}
+	}
+	return nil
+}
+
+func (list *banList) save() error {
+	if list.file == "" {
+		return nil
+	}
+	bytes, err := json.MarshalIndent(list.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	temporaryFile := list.file + ".tmp"
+	if err := os.WriteFile(temporaryFile, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile, list.file)
+}
+
+func (list *banList) sorted() []Ban {
+	bans := make([]Ban, 0, len(list.bans))
+	for _, ban := range list.bans {
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created.Before(bans[j].Created)
+	})
+	return bans
+}
+
+func (list *banList) add(ban Ban) error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.bans[ban.Address] = ban
+	return list.save()
+}
+
+func (list *banList) remove(address string) (bool, error) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	_, found := list.bans[address]
+	if !found {
+		return false, nil
+	}
+	delete(list.bans, address)
+	return true, list.save()
+}
+
+func (list *banList) isBanned(ip net.IP) bool {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if len(list.bans) == 0 {
+		return false
+	}
+	ban, found := list.bans[ip.String()]
+	return found && !ban.expired()
+}
+
+func (list *banList) list() []Ban {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	return list.sorted()
+}
+
+// Remove bans that have expired
+func (list *banList) clean() error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	changed := false
+	for address, ban := range list.bans {
+		if ban.expired() {
+			delete(list.bans, address)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return list.save()
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fuglesteg/timid/logging"
+)
+
+const (
+	maxCaptureDuration = time.Hour
+	// Capture files kept in the capture directory, older ones are removed
+	// when a capture starts
+	maxCaptureFiles = 10
+	// Capture files are named timid-<UTC time>.pcapng, so they sort by time
+	captureFilePattern = "timid-*.pcapng"
+)
+
+var ErrCaptureRunning = errors.New("A capture is already running")
+var ErrNoCapture = errors.New("No capture has been made")
+
+// Snapshot of a capture of proxied datagrams
+type CaptureInfo struct {
+	File    string
+	Client  string // Client IP or IP:port address captured, every client if empty
+	Started time.Time
+	Until   time.Time
+	Packets uint64
+	Running bool
+	Error   string // Set if writing the capture failed
+}
+
+type capture struct {
+	info   CaptureInfo
+	file   *os.File
+	buffer *bufio.Writer
+	pcapng *pcapngWriter
+	mutex  sync.Mutex
+}
+
+// Directory captures are written to, the temporary directory if unset
+func (proxy *Proxy) SetCaptureDir(dir string) {
+	proxy.captureDir = dir
+}
+
+// Capture datagrams of all clients, or of a single client, in both
+// directions to a pcapng file for the given duration
+func (proxy *Proxy) StartCapture(duration time.Duration, client string) (CaptureInfo, error) {
+	if duration <= 0 || duration > maxCaptureDuration {
+		return CaptureInfo{}, fmt.Errorf("Capture duration must be between 0 and %s", maxCaptureDuration.String())
+	}
+	if client != "" {
+		filter := PacketTrace{Mode: TraceOff, Clients: []string{client}}
+		if err := filter.validate(); err != nil {
+			return CaptureInfo{}, err
+		}
+	}
+
+	proxy.captureMutex.Lock()
+	defer proxy.captureMutex.Unlock()
+	if current := proxy.capture.Load(); current != nil && current.snapshot().Running {
+		return CaptureInfo{}, ErrCaptureRunning
+	}
+	dir := proxy.captureDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	started := time.Now()
+	file, err := createCaptureFile(dir, started)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+	fileName := file.Name()
+	removeOldCaptures(dir)
+	buffer := bufio.NewWriter(file)
+	pcapng, err := newPcapngWriter(buffer)
+	if err != nil {
+		file.Close()
+		return CaptureInfo{}, err
+	}
+	capture := &capture{
+		info: CaptureInfo{
+			File:    fileName,
+			Client:  client,
+			Started: started,
+			Until:   started.Add(duration),
+			Running: true,
+		},
+		file:   file,
+		buffer: buffer,
+		pcapng: pcapng,
+	}
+	proxy.capture.Store(capture)
+	time.AfterFunc(duration, capture.stop)
+	logger.Info("Capture started", "file", fileName, logging.Client(client), "duration", duration.String())
+	return capture.snapshot(), nil
+}
+
+// Create a new capture file, never replacing an earlier capture that is
+// still being downloaded
+func createCaptureFile(dir string, started time.Time) (*os.File, error) {
+	name := "timid-" + started.UTC().Format("20060102-150405.000000000")
+	for attempt := 0; ; attempt++ {
+		fileName := filepath.Join(dir, name+".pcapng")
+		if attempt > 0 {
+			fileName = filepath.Join(dir, fmt.Sprintf("%s-%d.pcapng", name, attempt))
+		}
+		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, os.ErrExist) || attempt == 100 {
+			return file, err
+		}
+	}
+}
+
+// Remove all but the newest maxCaptureFiles capture files in dir
+func removeOldCaptures(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, captureFilePattern))
+	if err != nil || len(files) <= maxCaptureFiles {
+		return
+	}
+	slices.Sort(files)
+	for _, file := range files[:len(files)-maxCaptureFiles] {
+		if err := os.Remove(file); err != nil {
+			logger.Warn("Failed to remove old capture", "file", file, logging.Err(err))
+		}
+	}
+}
+
+// The running or last capture
+func (proxy *Proxy) GetCapture() (CaptureInfo, error) {
+	capture := proxy.capture.Load()
+	if capture == nil {
+		return CaptureInfo{}, ErrNoCapture
+	}
+	return capture.snapshot(), nil
+}
+
+func (capture *capture) snapshot() CaptureInfo {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	return capture.info
+}
+
+func (capture *capture) matches(clientAddr *net.UDPAddr) bool {
+	client := capture.info.Client
+	return client == "" || client == clientAddr.IP.String() || client == clientAddr.String()
+}
+
+func (capture *capture) stop() {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if !capture.info.Running {
+		return
+	}
+	capture.info.Running = false
+	err := errors.Join(capture.buffer.Flush(), capture.file.Close())
+	if err != nil {
+		capture.fail(err)
+		return
+	}
+	logger.Info("Capture finished", "file", capture.info.File, "packets", capture.info.Packets)
+}
+
+// Must be called with the capture locked
+func (capture *capture) fail(err error) {
+	logger.Error("Capture failed", "file", capture.info.File, logging.Err(err))
+	capture.info.Error = err.Error()
+	if capture.info.Running {
+		capture.info.Running = false
+		capture.file.Close()
+	}
+}
+
+// Record a datagram if a capture of the client is running
+func (proxy *Proxy) capturePacket(clientAddr *net.UDPAddr, src *net.UDPAddr, dst *net.UDPAddr, payload []byte) {
+	capture := proxy.capture.Load()
+	if capture == nil {
+		return
+	}
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if !capture.info.Running || !capture.matches(clientAddr) {
+		return
+	}
+	if err := capture.pcapng.writeDatagram(time.Now(), src, dst, payload); err != nil {
+		capture.fail(err)
+		return
+	}
+	capture.info.Packets++
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForCapture(t *testing.T, proxy *Proxy) CaptureInfo {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		info, err := proxy.GetCapture()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Running {
+			return info
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Capture did not finish")
+	return CaptureInfo{}
+}
+
+func TestCapturesInTheSameSecondKeepTheirFiles(t *testing.T) {
+	proxy := new(Proxy)
+	proxy.SetCaptureDir(t.TempDir())
+	files := make(map[string]bool)
+	for range 3 {
+		if _, err := proxy.StartCapture(time.Millisecond, ""); err != nil {
+			t.Fatal(err)
+		}
+		info := waitForCapture(t, proxy)
+		if info.Error != "" {
+			t.Fatal(info.Error)
+		}
+		if files[info.File] {
+			t.Fatalf("Capture file %s reused", info.File)
+		}
+		files[info.File] = true
+	}
+}
+
+func TestOldCapturesAreRemoved(t *testing.T) {
+	dir := t.TempDir()
+	proxy := new(Proxy)
+	proxy.SetCaptureDir(dir)
+	var last string
+	for range maxCaptureFiles + 3 {
+		if _, err := proxy.StartCapture(time.Millisecond, ""); err != nil {
+			t.Fatal(err)
+		}
+		last = waitForCapture(t, proxy).File
+	}
+	files, err := filepath.Glob(filepath.Join(dir, captureFilePattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != maxCaptureFiles {
+		t.Fatalf("%d capture files kept, want %d", len(files), maxCaptureFiles)
+	}
+	if files[len(files)-1] != last {
+		t.Fatalf("Newest capture %s removed, kept %v", last, files)
+	}
+}
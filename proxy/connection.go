@@ -2,29 +2,125 @@ package proxy
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fuglesteg/timid/verboseLog"
+	"github.com/fuglesteg/timid/logging"
 )
 
+// Opens a UDP connection to the server on behalf of a client
+type dialFunc func(srvAddr, cliAddr *net.UDPAddr) (*net.UDPConn, error)
+
+// Default session backend, the server sees traffic coming from the proxy
+func dialServer(srvAddr, cliAddr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.DialUDP("udp", nil, srvAddr)
+}
+
 // Information maintained for each client/server connection
 type connection struct {
 	ClientAddr *net.UDPAddr // Address of the client
+	ReplyAddr  *net.UDPAddr // Address replies are sent to, the upstream proxy if the client came through one
 	ServerConn *net.UDPConn // UDP connection to server
-        LastUsed   *time.Time
+	LastUsed   *time.Time
+	Created    time.Time
+
+	// Traffic relayed for the connection
+	packetsFromClient atomic.Uint64
+	bytesFromClient   atomic.Uint64
+	packetsFromServer atomic.Uint64
+	bytesFromServer   atomic.Uint64
+
+	// Opens connections to the server
+	dial dialFunc
+
+	// Guards ServerConn while the connection is migrated to a new server address
+	mutex  sync.Mutex
+	closed bool
 }
 
 func (connection *connection) UpdateLastUsed() {
-    timeNow := time.Now()
-    connection.LastUsed = &timeNow
+	timeNow := time.Now()
+	connection.LastUsed = &timeNow
+}
+
+// Snapshot of a connection
+type ConnectionInfo struct {
+	ClientAddr        string
+	Created           time.Time
+	LastUsed          time.Time
+	PacketsFromClient uint64
+	BytesFromClient   uint64
+	PacketsFromServer uint64
+	BytesFromServer   uint64
+}
+
+func (connection *connection) info() ConnectionInfo {
+	return ConnectionInfo{
+		ClientAddr:        connection.ClientAddr.String(),
+		Created:           connection.Created,
+		LastUsed:          *connection.LastUsed,
+		PacketsFromClient: connection.packetsFromClient.Load(),
+		BytesFromClient:   connection.bytesFromClient.Load(),
+		PacketsFromServer: connection.packetsFromServer.Load(),
+		BytesFromServer:   connection.bytesFromServer.Load(),
+	}
+}
+
+func (connection *connection) serverConn() *net.UDPConn {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.ServerConn
+}
+
+func (connection *connection) serverAddr() *net.UDPAddr {
+	return connection.serverConn().RemoteAddr().(*net.UDPAddr)
+}
+
+func (connection *connection) isClosed() bool {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.closed
+}
+
+// Point the connection at a new server address, the old server connection is
+// closed which makes runConnection pick up the new one
+func (connection *connection) migrate(srvAddr *net.UDPAddr) error {
+	srvUdp, err := connection.dial(srvAddr, connection.ClientAddr)
+	if err != nil {
+		return err
+	}
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if connection.closed {
+		return srvUdp.Close()
+	}
+	oldConn := connection.ServerConn
+	connection.ServerConn = srvUdp
+	return oldConn.Close()
+}
+
+// Close the connection to the server, stopping runConnection
+func (connection *connection) Close() error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if connection.closed {
+		return nil
+	}
+	connection.closed = true
+	return connection.ServerConn.Close()
 }
 
 // Generate a new connection by opening a UDP connection to the server
-func newConnection(srvAddr, cliAddr *net.UDPAddr) *connection {
+func newConnection(srvAddr, cliAddr *net.UDPAddr, dial dialFunc) *connection {
 	conn := new(connection)
 	conn.ClientAddr = cliAddr
-	srvUdp, err := net.DialUDP("udp", nil, srvAddr)
-	if verboseLog.Checkreport(1, err) {
+	conn.ReplyAddr = cliAddr
+	conn.Created = time.Now()
+	conn.dial = dial
+	srvUdp, err := dial(srvAddr, cliAddr)
+	if err != nil {
+		logger.Error("Failed to connect to server", logging.Client(cliAddr.String()), logging.Err(err))
 		return nil
 	}
 	conn.ServerConn = srvUdp
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"time"
+)
+
+// How often the proxy loop wakes up while no packets arrive, so a stalled
+// loop can be told apart from an idle one
+const loopHeartbeatInterval = time.Second
+
+func (proxy *Proxy) heartbeat() {
+	proxy.lastLoop.Store(time.Now().UnixNano())
+}
+
+// Last time the proxy loop made progress
+func (proxy *Proxy) LastLoop() time.Time {
+	return time.Unix(0, proxy.lastLoop.Load())
+}
+
+// Whether the proxy is bound to its port
+func (proxy *Proxy) Listening() bool {
+	proxy.dlock()
+	defer proxy.dunlock()
+	return proxy.proxyConn != nil
+}
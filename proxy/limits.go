@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CIDR based allow and deny lists for client addresses
+type AccessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Parse comma separated lists of CIDRs, single addresses are treated as a
+// network with only that address
+func ParseAccessList(allow string, deny string) (*AccessList, error) {
+	accessList := new(AccessList)
+	var err error
+	accessList.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	accessList.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return accessList, nil
+}
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address in access list: %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR in access list: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Deny takes precedence over allow, an empty allow list allows everything
+// that is not denied
+func (accessList *AccessList) Allowed(ip net.IP) bool {
+	for _, network := range accessList.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(accessList.allow) == 0 {
+		return true
+	}
+	for _, network := range accessList.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Simple token bucket, refilled continuously at rate tokens per second up to
+// burst tokens
+type tokenBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, lastFill: time.Now()}
+}
+
+func (bucket *tokenBucket) fill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.lastFill).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.lastFill = now
+}
+
+func (bucket *tokenBucket) has(amount float64) bool {
+	return bucket.tokens >= amount
+}
+
+// Rate limits for a single client address
+type clientLimiter struct {
+	packets *tokenBucket
+	bytes   *tokenBucket
+	lastUse time.Time
+}
+
+// Per client token bucket rate limiting, a rate of 0 disables the limit
+type rateLimiter struct {
+	packetRate float64
+	byteRate   float64
+	clients    map[string]*clientLimiter
+	mutex      sync.Mutex
+}
+
+func newRateLimiter(packetRate int, byteRate int) *rateLimiter {
+	return &rateLimiter{
+		packetRate: float64(packetRate),
+		byteRate:   float64(byteRate),
+		clients:    make(map[string]*clientLimiter),
+	}
+}
+
+func (limiter *rateLimiter) enabled() bool {
+	return limiter.packetRate > 0 || limiter.byteRate > 0
+}
+
+// Returns whether a packet of size bytes from the client is within the limits,
+// tokens are only taken if it is within both
+func (limiter *rateLimiter) allow(client string, size int) (packetOk bool, byteOk bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	clientLimit, found := limiter.clients[client]
+	if !found {
+		clientLimit = new(clientLimiter)
+		if limiter.packetRate > 0 {
+			// Burst is capped at one second worth of packets
+			clientLimit.packets = newTokenBucket(limiter.packetRate, limiter.packetRate)
+		}
+		if limiter.byteRate > 0 {
+			// Burst is one second worth of bytes, but at least one packet of
+			// the largest size so it can get through with any rate
+			clientLimit.bytes = newTokenBucket(limiter.byteRate, max(limiter.byteRate, maxDatagramSize))
+		}
+		limiter.clients[client] = clientLimit
+	}
+	now := time.Now()
+	clientLimit.lastUse = now
+	packetOk, byteOk = true, true
+	if clientLimit.packets != nil {
+		clientLimit.packets.fill(now)
+		packetOk = clientLimit.packets.has(1)
+	}
+	if clientLimit.bytes != nil {
+		clientLimit.bytes.fill(now)
+		byteOk = clientLimit.bytes.has(float64(size))
+	}
+	if !packetOk || !byteOk {
+		return packetOk, byteOk
+	}
+	if clientLimit.packets != nil {
+		clientLimit.packets.tokens--
+	}
+	if clientLimit.bytes != nil {
+		clientLimit.bytes.tokens -= float64(size)
+	}
+	return true, true
+}
+
+// Forget clients that have not sent anything for the given duration
+func (limiter *rateLimiter) clean(unusedFor time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	for client, clientLimit := range limiter.clients {
+		if time.Since(clientLimit.lastUse) > unusedFor {
+			delete(limiter.clients, client)
+		}
+	}
+}
+
+// Counters for traffic rejected by the proxy
+type RejectedCounters struct {
+	Banned       uint64 // Packets from banned clients
+	Denied       uint64 // Packets from clients not allowed by the access list
+	PacketLimit  uint64 // Packets over the per client packet rate
+	ByteLimit    uint64 // Packets over the per client byte rate
+	SessionLimit uint64 // Packets from new clients while at the session cap
+	Bytes        uint64 // Total bytes rejected
+}
+
+type rejectedCounters struct {
+	banned       atomic.Uint64
+	denied       atomic.Uint64
+	packetLimit  atomic.Uint64
+	byteLimit    atomic.Uint64
+	sessionLimit atomic.Uint64
+	bytes        atomic.Uint64
+}
+
+func (counters *rejectedCounters) snapshot() RejectedCounters {
+	return RejectedCounters{
+		Banned:       counters.banned.Load(),
+		Denied:       counters.denied.Load(),
+		PacketLimit:  counters.packetLimit.Load(),
+		ByteLimit:    counters.byteLimit.Load(),
+		SessionLimit: counters.sessionLimit.Load(),
+		Bytes:        counters.bytes.Load(),
+	}
+}
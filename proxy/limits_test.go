@@ -0,0 +1,23 @@
+package proxy
+
+import "testing"
+
+func TestRateLimiterAllowsPacketLargerThanByteRate(t *testing.T) {
+	limiter := newRateLimiter(0, 100)
+	if _, byteOk := limiter.allow("192.0.2.1", 1500); !byteOk {
+		t.Fatal("full size packet rejected with a byte rate of 100")
+	}
+	if _, byteOk := limiter.allow("192.0.2.1", 150); byteOk {
+		t.Fatal("150 byte packet allowed right after a full size one")
+	}
+}
+
+func TestRateLimiterRejectedPacketTakesNoTokens(t *testing.T) {
+	limiter := newRateLimiter(1, 100)
+	if packetOk, byteOk := limiter.allow("192.0.2.1", 2000); !packetOk || byteOk {
+		t.Fatalf("oversized packet: packetOk %v byteOk %v, want true false", packetOk, byteOk)
+	}
+	if packetOk, byteOk := limiter.allow("192.0.2.1", 10); !packetOk || !byteOk {
+		t.Fatalf("packet after a rejected one: packetOk %v byteOk %v, want true true", packetOk, byteOk)
+	}
+}
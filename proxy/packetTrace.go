@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/fuglesteg/timid/logging"
+)
+
+// What is logged for every traced packet
+const (
+	TraceOff    = "off"
+	TraceLength = "length" // Only the length of the payload
+	TraceHex    = "hex"    // The payload as hex, up to MaxBytes
+)
+
+// Directions of proxied packets
+const (
+	FromClient = "client"
+	FromServer = "server"
+)
+
+const defaultTraceMaxBytes = 64
+
+var packetLogger = logging.For(logging.Packets)
+
+// Logging of proxied packets, enabled at runtime independently of the log
+// level
+type PacketTrace struct {
+	Mode string
+	// Fraction of packets traced, 0 or 1 traces every packet
+	SampleRate float64
+	// Client IP or IP:port addresses to trace, every client if empty
+	Clients []string
+	// Bytes of the payload included in hex mode
+	MaxBytes int
+	// Tracing is turned off after this time, never if zero
+	Until time.Time
+}
+
+func (trace *PacketTrace) validate() error {
+	switch trace.Mode {
+	case TraceOff, TraceLength, TraceHex:
+	default:
+		return fmt.Errorf("Unknown packet trace mode: %s", trace.Mode)
+	}
+	if trace.SampleRate < 0 || trace.SampleRate > 1 {
+		return fmt.Errorf("Packet trace sample rate must be between 0 and 1: %g", trace.SampleRate)
+	}
+	if trace.MaxBytes < 0 {
+		return fmt.Errorf("Packet trace max bytes can't be negative: %d", trace.MaxBytes)
+	}
+	for _, client := range trace.Clients {
+		if net.ParseIP(client) != nil {
+			continue
+		}
+		if _, err := net.ResolveUDPAddr("udp", client); err != nil {
+			return fmt.Errorf("Invalid packet trace client: %s", client)
+		}
+	}
+	return nil
+}
+
+func (trace *PacketTrace) matches(clientAddr *net.UDPAddr) bool {
+	if len(trace.Clients) == 0 {
+		return true
+	}
+	for _, client := range trace.Clients {
+		if client == clientAddr.IP.String() || client == clientAddr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Turn packet tracing on or off
+func (proxy *Proxy) SetPacketTrace(trace PacketTrace) error {
+	if trace.Mode == "" {
+		trace.Mode = TraceOff
+	}
+	if err := trace.validate(); err != nil {
+		return err
+	}
+	if trace.Mode == TraceOff {
+		proxy.packetTrace.Store(nil)
+		logger.Info("Packet trace disabled")
+		return nil
+	}
+	if trace.MaxBytes == 0 {
+		trace.MaxBytes = defaultTraceMaxBytes
+	}
+	proxy.packetTrace.Store(&trace)
+	logger.Info("Packet trace enabled", "mode", trace.Mode, "sampleRate", trace.SampleRate,
+		"clients", trace.Clients, "until", trace.Until)
+	return nil
+}
+
+func (proxy *Proxy) GetPacketTrace() PacketTrace {
+	trace := proxy.activePacketTrace()
+	if trace == nil {
+		return PacketTrace{Mode: TraceOff}
+	}
+	return *trace
+}
+
+func (proxy *Proxy) activePacketTrace() *PacketTrace {
+	trace := proxy.packetTrace.Load()
+	if trace == nil {
+		return nil
+	}
+	if !trace.Until.IsZero() && time.Now().After(trace.Until) {
+		if proxy.packetTrace.CompareAndSwap(trace, nil) {
+			logger.Info("Packet trace expired")
+		}
+		return nil
+	}
+	return trace
+}
+
+// Log a proxied packet if tracing is enabled for the client
+func (proxy *Proxy) tracePacket(direction string, clientAddr *net.UDPAddr, payload []byte) {
+	trace := proxy.activePacketTrace()
+	if trace == nil || !trace.matches(clientAddr) {
+		return
+	}
+	if trace.SampleRate > 0 && trace.SampleRate < 1 && rand.Float64() >= trace.SampleRate {
+		return
+	}
+	attrs := []any{"from", direction, logging.Client(clientAddr.String()), "length", len(payload)}
+	if trace.Mode == TraceHex {
+		dumped := payload[0:min(len(payload), trace.MaxBytes)]
+		attrs = append(attrs, "hex", hex.EncodeToString(dumped), "truncated", len(dumped) < len(payload))
+	}
+	packetLogger.Info("Packet", attrs...)
+}
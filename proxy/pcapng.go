@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// Minimal pcapng writer, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+// Datagrams are written as raw IP packets with synthetic IP and UDP headers,
+// as the proxy only sees the UDP payload.
+
+const (
+	pcapngSectionHeaderBlock        = 0x0A0D0D0A
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+	pcapngByteOrderMagic            = 0x1A2B3C4D
+
+	linkTypeRaw = 101 // Raw IPv4 or IPv6 packets
+
+	udpProtocol  = 17
+	ipTimeToLive = 64
+)
+
+type pcapngWriter struct {
+	writer io.Writer
+}
+
+func newPcapngWriter(writer io.Writer) (*pcapngWriter, error) {
+	pcapng := &pcapngWriter{writer: writer}
+	var sectionHeader []byte
+	sectionHeader = binary.LittleEndian.AppendUint32(sectionHeader, pcapngByteOrderMagic)
+	sectionHeader = binary.LittleEndian.AppendUint16(sectionHeader, 1) // Major version
+	sectionHeader = binary.LittleEndian.AppendUint16(sectionHeader, 0) // Minor version
+	sectionHeader = binary.LittleEndian.AppendUint64(sectionHeader, ^uint64(0)) // Section length unknown
+	if err := pcapng.writeBlock(pcapngSectionHeaderBlock, sectionHeader); err != nil {
+		return nil, err
+	}
+	var interfaceDescription []byte
+	interfaceDescription = binary.LittleEndian.AppendUint16(interfaceDescription, linkTypeRaw)
+	interfaceDescription = binary.LittleEndian.AppendUint16(interfaceDescription, 0) // Reserved
+	interfaceDescription = binary.LittleEndian.AppendUint32(interfaceDescription, 0) // No snapshot length limit
+	if err := pcapng.writeBlock(pcapngInterfaceDescriptionBlock, interfaceDescription); err != nil {
+		return nil, err
+	}
+	return pcapng, nil
+}
+
+func (pcapng *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	padding := (4 - len(body)%4) % 4
+	length := uint32(12 + len(body) + padding)
+	var block []byte
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = append(block, make([]byte, padding)...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := pcapng.writer.Write(block)
+	return err
+}
+
+// Write a UDP datagram from src to dst, timestamps have microsecond resolution
+func (pcapng *pcapngWriter) writeDatagram(timestamp time.Time, src *net.UDPAddr, dst *net.UDPAddr, payload []byte) error {
+	packet := encodeUDPPacket(src, dst, payload)
+	microseconds := uint64(timestamp.UnixMicro())
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, 0) // Interface ID
+	body = binary.LittleEndian.AppendUint32(body, uint32(microseconds>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(microseconds))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet))) // Captured length
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet))) // Original length
+	body = append(body, packet...)
+	return pcapng.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+// Build an IPv4 packet if both addresses are IPv4, otherwise an IPv6 packet
+// with IPv4 addresses mapped to IPv6
+func encodeUDPPacket(src *net.UDPAddr, dst *net.UDPAddr, payload []byte) []byte {
+	srcIp4, dstIp4 := src.IP.To4(), dst.IP.To4()
+	udpLength := 8 + len(payload)
+	var header []byte
+	var pseudoHeader []byte
+	if srcIp4 != nil && dstIp4 != nil {
+		header = append(header, 0x45, 0) // Version 4, 20 byte header, no TOS
+		header = binary.BigEndian.AppendUint16(header, uint16(20+udpLength))
+		header = binary.BigEndian.AppendUint16(header, 0)      // Identification
+		header = binary.BigEndian.AppendUint16(header, 0x4000) // Don't fragment
+		header = append(header, ipTimeToLive, udpProtocol)
+		header = binary.BigEndian.AppendUint16(header, 0) // Checksum, filled in below
+		header = append(header, srcIp4...)
+		header = append(header, dstIp4...)
+		binary.BigEndian.PutUint16(header[10:12], internetChecksum(header))
+
+		pseudoHeader = append(pseudoHeader, srcIp4...)
+		pseudoHeader = append(pseudoHeader, dstIp4...)
+		pseudoHeader = append(pseudoHeader, 0, udpProtocol)
+		pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(udpLength))
+	} else {
+		header = binary.BigEndian.AppendUint32(header, 0x60000000) // Version 6
+		header = binary.BigEndian.AppendUint16(header, uint16(udpLength))
+		header = append(header, udpProtocol, ipTimeToLive)
+		header = append(header, src.IP.To16()...)
+		header = append(header, dst.IP.To16()...)
+
+		pseudoHeader = append(pseudoHeader, src.IP.To16()...)
+		pseudoHeader = append(pseudoHeader, dst.IP.To16()...)
+		pseudoHeader = binary.BigEndian.AppendUint32(pseudoHeader, uint32(udpLength))
+		pseudoHeader = append(pseudoHeader, 0, 0, 0, udpProtocol)
+	}
+
+	var udp []byte
+	udp = binary.BigEndian.AppendUint16(udp, uint16(src.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(dst.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLength))
+	udp = binary.BigEndian.AppendUint16(udp, 0) // Checksum, filled in below
+	udp = append(udp, payload...)
+	checksum := internetChecksum(append(pseudoHeader, udp...))
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(udp[6:8], checksum)
+
+	return append(header, udp...)
+}
+
+// RFC 1071 checksum
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
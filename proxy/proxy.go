@@ -1,14 +1,29 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fuglesteg/timid/verboseLog"
+	"github.com/fuglesteg/timid/logging"
 )
 
+var logger = logging.For(logging.Proxy)
+
+// Largest datagram relayed in either direction
+const maxDatagramSize = 1500
+
+// Packet level logs are guarded so attributes aren't built for every packet
+func tracing() bool {
+	return logger.Enabled(context.Background(), logging.LevelTrace)
+}
+
 type Proxy struct {
 	// Server address as string
 	targetAddr string
@@ -22,6 +37,12 @@ type Proxy struct {
 	// Address of server
 	serverAddr *net.UDPAddr
 
+	// How often the target address is resolved again, 0 disables it
+	resolveInterval time.Duration
+
+	// Set while the target address is being resolved
+	resolving atomic.Bool
+
 	// Mapping from client addresses (as host:port) to connection
 	clientDict map[string]*connection
 
@@ -29,9 +50,48 @@ type Proxy struct {
 	dmutex *sync.Mutex
 
 	// Time until the proxy treats a connection as unused
-	timeOutDelay time.Duration
+	timeOutDelay atomic.Int64
+
+	// Clients allowed to use the proxy, nil allows everyone
+	accessList *AccessList
+
+	// Per client packet and byte rate limits
+	rateLimiter *rateLimiter
+
+	// Client addresses banned from using the proxy
+	bans *banList
+
+	// Session backend used to open connections to the server
+	dial dialFunc
+
+	// Prepend a PROXY protocol v2 header to datagrams sent to the server
+	sendProxyHeader bool
+
+	// Upstream proxies allowed to send PROXY protocol headers, nil disables them
+	proxyHeaderTrusted *AccessList
+
+	// Maximum amount of concurrent connections, 0 is unlimited
+	maxSessions int
+
+	// Counters for traffic rejected by the access list or limits
+	rejected rejectedCounters
+
+	// Packets logged while set, nil disables tracing
+	packetTrace atomic.Pointer[PacketTrace]
 
-	// Channel which reacts to new connections
+	// Running or last capture of datagrams, captureMutex serializes starting one
+	capture      atomic.Pointer[capture]
+	captureMutex sync.Mutex
+	captureDir   string
+
+	// Called with a snapshot of every connection that is removed, must not block
+	sessionListener func(ConnectionInfo)
+
+	// Unix nano time the proxy loop last made progress
+	lastLoop atomic.Int64
+
+	// Channel which reacts to new connections, a pending notification stands
+	// for all connections made until it is received
 	OnNewConnection chan int
 }
 
@@ -39,10 +99,14 @@ func NewProxy(proxyPort int, targetAddress string, connectionTimeoutDelay time.D
 	proxy := new(Proxy)
 	proxy.clientDict = make(map[string]*connection)
 	proxy.dmutex = new(sync.Mutex)
-	proxy.timeOutDelay = connectionTimeoutDelay
+	proxy.timeOutDelay.Store(int64(connectionTimeoutDelay))
 	proxy.targetAddr = targetAddress
 	proxy.port = proxyPort
-	proxy.OnNewConnection = make(chan int)
+	proxy.rateLimiter = newRateLimiter(0, 0)
+	proxy.bans = newBanList()
+	proxy.dial = dialServer
+	proxy.OnNewConnection = make(chan int, 1)
+	proxy.heartbeat()
 	err := proxy.setup()
 
 	return proxy, err
@@ -56,14 +120,201 @@ func (proxy *Proxy) GetTargetAddress() string {
 	return proxy.targetAddr;
 }
 
+// Set how often the target address should be resolved again, useful when
+// the target container is recreated with a new IP
+func (proxy *Proxy) SetResolveInterval(interval time.Duration) {
+	proxy.resolveInterval = interval
+}
+
+// Change the time until the proxy treats a connection as unused
+func (proxy *Proxy) SetConnectionTimeoutDelay(delay time.Duration) {
+	proxy.timeOutDelay.Store(int64(delay))
+}
+
+func (proxy *Proxy) SetAccessList(accessList *AccessList) {
+	proxy.accessList = accessList
+}
+
+// Limit each client address to a rate of packets and bytes per second, 0
+// disables the limit
+func (proxy *Proxy) SetClientRateLimit(packetsPerSecond int, bytesPerSecond int) {
+	proxy.rateLimiter = newRateLimiter(packetsPerSecond, bytesPerSecond)
+}
+
+func (proxy *Proxy) SetMaxSessions(maxSessions int) {
+	proxy.maxSessions = maxSessions
+}
+
+// Use the client address as the source address of traffic sent to the
+// server, only supported on Linux
+func (proxy *Proxy) SetTransparent(transparent bool) error {
+	if !transparent {
+		proxy.dial = dialServer
+		return nil
+	}
+	if err := transparentSupported(); err != nil {
+		return err
+	}
+	proxy.dial = dialTransparent
+	return nil
+}
+
+// Send the address of the client to the server with a PROXY protocol v2
+// header prepended to every datagram
+func (proxy *Proxy) SetSendProxyHeader(sendProxyHeader bool) {
+	proxy.sendProxyHeader = sendProxyHeader
+}
+
+// Accept PROXY protocol v2 headers from upstream proxies in the access list,
+// the address in the header is then treated as the client address
+func (proxy *Proxy) SetProxyHeaderTrusted(trusted *AccessList) {
+	proxy.proxyHeaderTrusted = trusted
+}
+
+// Be notified of every connection that is closed, the listener is called
+// with the connections locked and must not block
+func (proxy *Proxy) SetSessionListener(listener func(ConnectionInfo)) {
+	proxy.sessionListener = listener
+}
+
+func (proxy *Proxy) GetRejectedCounters() RejectedCounters {
+	return proxy.rejected.snapshot()
+}
+
+// Load bans from a JSON file, changes to the bans are written back to it
+func (proxy *Proxy) SetBanFile(file string) error {
+	return proxy.bans.load(file)
+}
+
+// Ban a client address, a duration of 0 makes the ban permanent. Existing
+// connections from the address are kicked
+func (proxy *Proxy) Ban(address string, duration time.Duration, reason string) (Ban, error) {
+	address, err := normalizeBanAddress(address)
+	if err != nil {
+		return Ban{}, err
+	}
+	ban := Ban{Address: address, Reason: reason, Created: time.Now()}
+	if duration > 0 {
+		expires := ban.Created.Add(duration)
+		ban.Expires = &expires
+	}
+	if err := proxy.bans.add(ban); err != nil {
+		return ban, err
+	}
+	logger.Info("Banned client address", logging.Client(address), "reason", reason)
+
+	proxy.dlock()
+	defer proxy.dunlock()
+	for clientAddr, connection := range proxy.clientDict {
+		if connection.ClientAddr.IP.String() == address {
+			proxy.removeConnection(clientAddr)
+		}
+	}
+	return ban, nil
+}
+
+// Returns false if the address was not banned
+func (proxy *Proxy) Unban(address string) (bool, error) {
+	address, err := normalizeBanAddress(address)
+	if err != nil {
+		return false, err
+	}
+	removed, err := proxy.bans.remove(address)
+	if removed {
+		logger.Info("Unbanned client address", logging.Client(address))
+	}
+	return removed, err
+}
+
+func (proxy *Proxy) GetBans() []Ban {
+	return proxy.bans.list()
+}
+
+func (proxy *Proxy) GetConnections() []ConnectionInfo {
+	proxy.dlock()
+	defer proxy.dunlock()
+	connections := make([]ConnectionInfo, 0, len(proxy.clientDict))
+	for _, connection := range proxy.clientDict {
+		connections = append(connections, connection.info())
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Created.Before(connections[j].Created)
+	})
+	return connections
+}
+
+// Remove the connection for a client address, returns false if there is no
+// such connection
+func (proxy *Proxy) KickConnection(clientAddr string) bool {
+	proxy.dlock()
+	defer proxy.dunlock()
+	if _, found := proxy.clientDict[clientAddr]; !found {
+		return false
+	}
+	proxy.removeConnection(clientAddr)
+	logger.Info("Kicked connection", logging.Client(clientAddr))
+	return true
+}
+
+// Must be called with the dictionary locked
+func (proxy *Proxy) removeConnection(clientAddr string) {
+	connection := proxy.clientDict[clientAddr]
+	delete(proxy.clientDict, clientAddr)
+	if proxy.sessionListener != nil {
+		proxy.sessionListener(connection.info())
+	}
+	if err := connection.Close(); err != nil {
+		logger.Debug("Failed to close connection", logging.Client(clientAddr), logging.Err(err))
+	}
+}
+
+// Check bans, the access list and rate limits for a packet from a client
+func (proxy *Proxy) admit(clientAddr *net.UDPAddr, size int) bool {
+	if proxy.bans.isBanned(clientAddr.IP) {
+		proxy.rejected.banned.Add(1)
+		proxy.rejected.bytes.Add(uint64(size))
+		logger.Debug("Rejected packet", logging.Client(clientAddr.String()), "reason", "banned")
+		return false
+	}
+	if proxy.accessList != nil && !proxy.accessList.Allowed(clientAddr.IP) {
+		proxy.rejected.denied.Add(1)
+		proxy.rejected.bytes.Add(uint64(size))
+		logger.Debug("Rejected packet", logging.Client(clientAddr.String()), "reason", "access list")
+		return false
+	}
+	if !proxy.rateLimiter.enabled() {
+		return true
+	}
+	packetOk, byteOk := proxy.rateLimiter.allow(clientAddr.IP.String(), size)
+	if !packetOk {
+		proxy.rejected.packetLimit.Add(1)
+	} else if !byteOk {
+		proxy.rejected.byteLimit.Add(1)
+	} else {
+		return true
+	}
+	proxy.rejected.bytes.Add(uint64(size))
+	if tracing() {
+		logger.Log(context.Background(), logging.LevelTrace, "Rejected packet",
+			logging.Client(clientAddr.String()), "reason", "rate limit")
+	}
+	return false
+}
+
 func (proxy *Proxy) CleanUnusedConnections() {
+	timeOutDelay := time.Duration(proxy.timeOutDelay.Load())
+	proxy.rateLimiter.clean(timeOutDelay)
+	if err := proxy.bans.clean(); err != nil {
+		logger.Warn("Failed to remove expired bans", logging.Err(err))
+	}
 	go func() {
+		proxy.dlock()
+		defer proxy.dunlock()
 		for _, connection := range proxy.clientDict {
-			timeoutReached := time.Since(*connection.LastUsed) > proxy.timeOutDelay
+			timeoutReached := time.Since(*connection.LastUsed) > timeOutDelay
 			if timeoutReached {
-				delete(proxy.clientDict, connection.ClientAddr.String())
-				verboseLog.Vlogf(2, "Removed unused connection for client: %s",
-					connection.ClientAddr.String())
+				proxy.removeConnection(connection.ClientAddr.String())
+				logger.Debug("Removed unused connection", logging.Client(connection.ClientAddr.String()))
 			}
 		}
 	}()
@@ -83,26 +334,60 @@ func (proxy *Proxy) setup() error {
 	// Set up Proxy
 	if proxy.proxyConn == nil {
 		saddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", proxy.port))
-		if verboseLog.Checkreport(1, err) {
+		if err != nil {
+			logger.Error("Failed to resolve proxy address", "port", proxy.port, logging.Err(err))
 			return err
 		}
 		pudp, err := net.ListenUDP("udp", saddr)
-		if verboseLog.Checkreport(1, err) {
+		if err != nil {
+			logger.Error("Failed to listen", "port", proxy.port, logging.Err(err))
 			return err
 		}
 		proxy.proxyConn = pudp
-		verboseLog.Vlogf(1, "Proxy serving on port %d\n", proxy.port)
+		logger.Info("Proxy serving", "port", proxy.port)
 	}
 
 	if proxy.serverAddr == nil {
 		// Get server address
 		srvaddr, err := net.ResolveUDPAddr("udp", proxy.targetAddr)
-		if verboseLog.Checkreport(1, err) {
+		if err != nil {
+			logger.Error("Failed to resolve target", "target", proxy.targetAddr, logging.Err(err))
 			proxy.serverAddr = nil
 			return err
 		}
 		proxy.serverAddr = srvaddr
-		verboseLog.Vlogf(1, "Connected to server at %s\n", proxy.targetAddr)
+		logger.Info("Connected to server", "target", proxy.targetAddr, "address", srvaddr.String())
+	}
+	return nil
+}
+
+// Resolve the target address again and move existing connections over to
+// the new address if it has changed
+func (proxy *Proxy) ResolveTarget() error {
+	if !proxy.resolving.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer proxy.resolving.Store(false)
+
+	srvaddr, err := net.ResolveUDPAddr("udp", proxy.targetAddr)
+	if err != nil {
+		return err
+	}
+
+	proxy.dlock()
+	defer proxy.dunlock()
+	if proxy.serverAddr != nil && proxy.serverAddr.String() == srvaddr.String() {
+		return nil
+	}
+	logger.Info("Target resolved to new address", "target", proxy.targetAddr, "address", srvaddr.String())
+	proxy.serverAddr = srvaddr
+	for _, connection := range proxy.clientDict {
+		err := connection.migrate(srvaddr)
+		if err != nil {
+			logger.Warn("Failed to migrate connection", logging.Client(connection.ClientAddr.String()), logging.Err(err))
+			continue
+		}
+		logger.Debug("Migrated connection", logging.Client(connection.ClientAddr.String()), "address", srvaddr.String())
 	}
 	return nil
 }
@@ -115,29 +400,51 @@ func (proxy *Proxy) dunlock() {
 	proxy.dmutex.Unlock()
 }
 
+// Notify OnNewConnection without waiting for the receiver, which might be
+// busy starting the containers. The proxy loop must not stall meanwhile, that
+// would make it look dead to the liveness check.
+func (proxy *Proxy) NotifyNewConnection() {
+	select {
+	case proxy.OnNewConnection <- 1:
+	default:
+		// A notification is already pending
+	}
+}
+
 // Go routine which manages connection from server to single client
 func (proxy *Proxy) runConnection(conn *connection) {
-	var buffer [1500]byte
+	var buffer [maxDatagramSize]byte
 	for {
 		// Read from server
-		n, err := conn.ServerConn.Read(buffer[0:])
-		if verboseLog.Checkreport(3, err) {
+		n, err := conn.serverConn().Read(buffer[0:])
+		if errors.Is(err, net.ErrClosed) {
+			if conn.isClosed() {
+				return
+			}
+			// Connection was migrated to a new server address
+			continue
+		}
+		if err != nil {
+			logger.Debug("Failed to read from server", logging.Client(conn.ClientAddr.String()), logging.Err(err))
 			continue
 		}
 		// Relay it to client
-		_, err = proxy.proxyConn.WriteToUDP(buffer[0:n], conn.ClientAddr)
-		if verboseLog.Checkreport(3, err) {
+		_, err = proxy.proxyConn.WriteToUDP(buffer[0:n], conn.ReplyAddr)
+		if err != nil {
+			logger.Debug("Failed to relay to client", logging.Client(conn.ClientAddr.String()), logging.Err(err))
 			continue
 		}
 		conn.UpdateLastUsed()
-		verboseLog.Vlogf(5, "Relayed '%s' from server to %s.\n",
-			string(buffer[0:n]), conn.ClientAddr.String())
+		conn.packetsFromServer.Add(1)
+		conn.bytesFromServer.Add(uint64(n))
+		proxy.tracePacket(FromServer, conn.ClientAddr, buffer[0:n])
+		proxy.capturePacket(conn.ClientAddr, conn.serverAddr(), conn.ClientAddr, buffer[0:n])
 	}
 }
 
 // Routine to handle inputs to Proxy port
 func (proxy *Proxy) RunProxy() {
-	var buffer [1500]byte
+	var buffer [maxDatagramSize]byte
 
 	go func() {
 		for {
@@ -146,45 +453,107 @@ func (proxy *Proxy) RunProxy() {
 		}
 	}()
 
+	if proxy.resolveInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(proxy.resolveInterval)
+				if err := proxy.ResolveTarget(); err != nil {
+					logger.Warn("Failed to resolve target", "target", proxy.targetAddr, logging.Err(err))
+				}
+			}
+		}()
+	}
+
 	for {
+		proxy.heartbeat()
+		proxy.proxyConn.SetReadDeadline(time.Now().Add(loopHeartbeatInterval))
 		n, clientAddr, err := proxy.proxyConn.ReadFromUDP(buffer[0:])
-		if verboseLog.Checkreport(1, err) {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to read from clients", logging.Err(err))
+			continue
+		}
+		payload := buffer[0:n]
+		replyAddr := clientAddr
+		// Address the client sent the datagram to
+		destinationAddr := proxy.proxyConn.LocalAddr().(*net.UDPAddr)
+		if proxy.proxyHeaderTrusted != nil && proxy.proxyHeaderTrusted.Allowed(clientAddr.IP) {
+			var headerAddr, headerDestinationAddr *net.UDPAddr
+			headerAddr, headerDestinationAddr, payload, err = parseProxyHeader(payload)
+			if err != nil {
+				logger.Debug("Rejected packet", logging.Client(clientAddr.String()), logging.Err(err))
+				continue
+			}
+			if headerAddr != nil {
+				clientAddr = headerAddr
+				destinationAddr = headerDestinationAddr
+			}
+		}
+		n = len(payload)
+		if !proxy.admit(clientAddr, n) {
 			continue
 		}
-		verboseLog.Vlogf(5, "Read '%s' from client %s\n",
-			string(buffer[0:n]), clientAddr.String())
+		proxy.tracePacket(FromClient, clientAddr, payload)
 		clientAddressString := clientAddr.String()
 		proxy.dlock()
 		if proxy.serverAddr == nil {
 			proxy.dunlock()
 			err := proxy.setup()
-			if verboseLog.Checkreport(2, err) {
+			if err != nil {
 				continue
 			}
 			proxy.dlock()
 		}
 		conn, found := proxy.clientDict[clientAddressString]
+		if !found && proxy.maxSessions > 0 && len(proxy.clientDict) >= proxy.maxSessions {
+			proxy.dunlock()
+			proxy.rejected.sessionLimit.Add(1)
+			proxy.rejected.bytes.Add(uint64(n))
+			logger.Debug("Rejected packet", logging.Client(clientAddressString), "reason", "session limit",
+				"maxSessions", proxy.maxSessions)
+			continue
+		}
 		if !found {
-			conn = newConnection(proxy.serverAddr, clientAddr)
+			conn = newConnection(proxy.serverAddr, clientAddr, proxy.dial)
 			if conn == nil {
 				proxy.dunlock()
 				continue
 			}
+			conn.ReplyAddr = replyAddr
 			proxy.clientDict[clientAddressString] = conn
 			conn.UpdateLastUsed()
 			proxy.dunlock()
-			verboseLog.Vlogf(2, "Created new connection for client %s\n", clientAddressString)
+			logger.Debug("Created new connection", logging.Client(clientAddressString))
 			// Fire up routine to manage new connection
 			go proxy.runConnection(conn)
-			proxy.OnNewConnection <- 1
+			proxy.NotifyNewConnection()
 		} else {
-			verboseLog.Vlogf(5, "Found connection for client %s\n", clientAddressString)
+			if tracing() {
+				logger.Log(context.Background(), logging.LevelTrace, "Found connection", logging.Client(clientAddressString))
+			}
 			proxy.dunlock()
 		}
 		// Relay to server
-		_, err = conn.ServerConn.Write(buffer[0:n])
-		if verboseLog.Checkreport(3, err) {
+		serverConn := conn.serverConn()
+		proxy.capturePacket(clientAddr, clientAddr, serverConn.RemoteAddr().(*net.UDPAddr), payload)
+		if proxy.sendProxyHeader {
+			header := encodeProxyHeader(clientAddr, destinationAddr)
+			payload = append(header, payload...)
+		}
+		_, err = serverConn.Write(payload)
+		if err != nil {
+			logger.Debug("Failed to relay to server", logging.Client(clientAddressString), logging.Err(err))
+			// Target might have moved, resolve it again
+			go func() {
+				if err := proxy.ResolveTarget(); err != nil {
+					logger.Warn("Failed to resolve target", "target", proxy.targetAddr, logging.Err(err))
+				}
+			}()
 			continue
 		}
+		conn.packetsFromClient.Add(1)
+		conn.bytesFromClient.Add(uint64(n))
 	}
 }
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// PROXY protocol version 2, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+// For UDP the header is prepended to every datagram.
+
+var proxyProtocolSignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtocolHeaderLength = 16
+
+	proxyProtocolVersion = 0x20
+	proxyProtocolLocal   = 0x00
+	proxyProtocolProxy   = 0x01
+
+	proxyProtocolUDPv4 = 0x12
+	proxyProtocolUDPv6 = 0x22
+
+	proxyProtocolIPv4AddressLength = 12
+	proxyProtocolIPv6AddressLength = 36
+)
+
+var errInvalidProxyHeader = errors.New("Invalid PROXY protocol header")
+
+// Build a PROXY protocol v2 header for a datagram from src to dst, the
+// address the client sent it to
+func encodeProxyHeader(src *net.UDPAddr, dst *net.UDPAddr) []byte {
+	srcIp4, dstIp4 := src.IP.To4(), dst.IP.To4()
+	if dst.IP.IsUnspecified() && srcIp4 != nil {
+		// Listening on all addresses, use the unspecified address of the
+		// client's family
+		dstIp4 = net.IPv4zero.To4()
+	}
+	var header []byte
+	header = append(header, proxyProtocolSignature...)
+	header = append(header, proxyProtocolVersion|proxyProtocolProxy)
+	if srcIp4 != nil && dstIp4 != nil {
+		header = append(header, proxyProtocolUDPv4)
+		header = binary.BigEndian.AppendUint16(header, proxyProtocolIPv4AddressLength)
+		header = append(header, srcIp4...)
+		header = append(header, dstIp4...)
+	} else {
+		header = append(header, proxyProtocolUDPv6)
+		header = binary.BigEndian.AppendUint16(header, proxyProtocolIPv6AddressLength)
+		header = append(header, src.IP.To16()...)
+		header = append(header, dst.IP.To16()...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(src.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+	return header
+}
+
+// Split a datagram into the source and destination addresses of a PROXY
+// protocol v2 header and the payload. Returns nil addresses if the datagram
+// has no header or the header is a LOCAL command.
+func parseProxyHeader(datagram []byte) (*net.UDPAddr, *net.UDPAddr, []byte, error) {
+	if len(datagram) < proxyProtocolHeaderLength ||
+		!bytes.Equal(datagram[0:len(proxyProtocolSignature)], proxyProtocolSignature) {
+		return nil, nil, datagram, nil
+	}
+	versionCommand := datagram[12]
+	family := datagram[13]
+	length := int(binary.BigEndian.Uint16(datagram[14:16]))
+	if versionCommand&0xF0 != proxyProtocolVersion ||
+		len(datagram) < proxyProtocolHeaderLength+length {
+		return nil, nil, datagram, errInvalidProxyHeader
+	}
+	addresses := datagram[proxyProtocolHeaderLength : proxyProtocolHeaderLength+length]
+	payload := datagram[proxyProtocolHeaderLength+length:]
+
+	switch versionCommand & 0x0F {
+	case proxyProtocolLocal:
+		return nil, nil, payload, nil
+	case proxyProtocolProxy:
+	default:
+		return nil, nil, datagram, errInvalidProxyHeader
+	}
+
+	var srcAddr, dstAddr *net.UDPAddr
+	switch family {
+	case proxyProtocolUDPv4:
+		if length < proxyProtocolIPv4AddressLength {
+			return nil, nil, datagram, errInvalidProxyHeader
+		}
+		srcAddr = &net.UDPAddr{
+			IP:   net.IP(bytes.Clone(addresses[0:4])),
+			Port: int(binary.BigEndian.Uint16(addresses[8:10])),
+		}
+		dstAddr = &net.UDPAddr{
+			IP:   net.IP(bytes.Clone(addresses[4:8])),
+			Port: int(binary.BigEndian.Uint16(addresses[10:12])),
+		}
+	case proxyProtocolUDPv6:
+		if length < proxyProtocolIPv6AddressLength {
+			return nil, nil, datagram, errInvalidProxyHeader
+		}
+		srcAddr = &net.UDPAddr{
+			IP:   net.IP(bytes.Clone(addresses[0:16])),
+			Port: int(binary.BigEndian.Uint16(addresses[32:34])),
+		}
+		dstAddr = &net.UDPAddr{
+			IP:   net.IP(bytes.Clone(addresses[16:32])),
+			Port: int(binary.BigEndian.Uint16(addresses[34:36])),
+		}
+	default:
+		// Unsupported address family, the sender is treated as the client
+		return nil, nil, payload, nil
+	}
+	return srcAddr, dstAddr, payload, nil
+}
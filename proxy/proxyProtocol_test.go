@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  *net.UDPAddr
+		dst  *net.UDPAddr
+	}{
+		{"IPv4", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}, &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 27015}},
+		{"IPv6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 27015}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			datagram := append(encodeProxyHeader(test.src, test.dst), "payload"...)
+			src, dst, payload, err := parseProxyHeader(datagram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !src.IP.Equal(test.src.IP) || src.Port != test.src.Port {
+				t.Errorf("source %s, want %s", src, test.src)
+			}
+			if !dst.IP.Equal(test.dst.IP) || dst.Port != test.dst.Port {
+				t.Errorf("destination %s, want %s", dst, test.dst)
+			}
+			if string(payload) != "payload" {
+				t.Errorf("payload %q, want %q", payload, "payload")
+			}
+		})
+	}
+}
+
+func TestProxyHeaderUnspecifiedDestinationTakesClientFamily(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	listener := &net.UDPAddr{IP: net.IPv6unspecified, Port: 27015}
+	_, dst, _, err := parseProxyHeader(encodeProxyHeader(src, listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.IP.To4() == nil || !dst.IP.IsUnspecified() || dst.Port != listener.Port {
+		t.Errorf("destination %s, want 0.0.0.0:%d", dst, listener.Port)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// Not exported by the syscall package
+const ipv6Transparent = 0x4b
+
+// Open a UDP connection to the server with the client address as the source
+// address. Requires CAP_NET_ADMIN and routing that delivers the replies from
+// the server to this host, see docs/transparent.md
+func dialTransparent(srvAddr, cliAddr *net.UDPAddr) (*net.UDPConn, error) {
+	dialer := net.Dialer{
+		LocalAddr: cliAddr,
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			var sockoptErr error
+			err := rawConn.Control(func(fd uintptr) {
+				sockoptErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if sockoptErr != nil {
+					return
+				}
+				if cliAddr.IP.To4() != nil {
+					sockoptErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				} else {
+					sockoptErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockoptErr
+		},
+	}
+	conn, err := dialer.Dial("udp", srvAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func transparentSupported() error {
+	return nil
+}
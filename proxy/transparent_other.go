@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("Transparent proxy mode is only supported on Linux")
+
+func dialTransparent(srvAddr, cliAddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func transparentSupported() error {
+	return errTransparentUnsupported
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set in processes the netns test starts from its own binary, to run as the
+// proxy, the server or the client in one of the namespaces
+const netnsHelperEnv = "TIMID_TEST_NETNS_HELPER"
+
+const (
+	netnsClientAddress = "10.0.1.2:40000"
+	netnsProxyAddress  = "10.0.1.1:2456"
+	netnsServerAddress = "10.0.2.2:2456"
+	netnsBufferSize    = 1500
+)
+
+// Not a test, the processes of TestTransparentProxyInNetworkNamespaces
+func TestTransparentNetnsHelper(t *testing.T) {
+	switch os.Getenv(netnsHelperEnv) {
+	case "proxy":
+		main()
+	case "server":
+		runNetnsServer()
+	case "client":
+		runNetnsClient()
+	default:
+		t.Skip("Only run by TestTransparentProxyInNetworkNamespaces")
+	}
+}
+
+// Reply to every datagram with the address it came from
+func runNetnsServer() {
+	address, _ := net.ResolveUDPAddr("udp4", netnsServerAddress)
+	conn, err := net.ListenUDP("udp4", address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	buffer := make([]byte, netnsBufferSize)
+	for {
+		_, clientAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			os.Exit(1)
+		}
+		conn.WriteToUDP([]byte("seen from "+clientAddr.String()), clientAddr)
+	}
+}
+
+// Send a datagram through the proxy and print the reply
+func runNetnsClient() {
+	local, _ := net.ResolveUDPAddr("udp4", netnsClientAddress)
+	remote, _ := net.ResolveUDPAddr("udp4", netnsProxyAddress)
+	conn, err := net.DialUDP("udp4", local, remote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	buffer := make([]byte, netnsBufferSize)
+	// The proxy might not be listening yet
+	for attempt := 0; attempt < 10; attempt++ {
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := conn.Read(buffer)
+		if err == nil {
+			fmt.Print(string(buffer[:n]))
+			os.Exit(0)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "No reply through the proxy")
+	os.Exit(1)
+}
+
+func ip(t *testing.T, args ...string) {
+	t.Helper()
+	if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %s: %s", strings.Join(args, " "), err, output)
+	}
+}
+
+// Start this test binary as a helper in a namespace
+func netnsHelper(namespace string, helper string, env ...string) *exec.Cmd {
+	command := exec.Command("ip", "netns", "exec", namespace, os.Args[0],
+		"-test.run=^TestTransparentNetnsHelper$")
+	command.Env = append(os.Environ(), append(env, netnsHelperEnv+"="+helper)...)
+	return command
+}
+
+// The server sees the address of the client instead of the proxy, see
+// docs/transparent.md. Needs root to create network namespaces, the topology
+// is client 10.0.1.2 <-> 10.0.1.1 proxy 10.0.2.1 <-> 10.0.2.2 server
+func TestTransparentProxyInNetworkNamespaces(t *testing.T) {
+	if os.Getenv(netnsHelperEnv) != "" {
+		t.Skip("Running as a helper")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("Network namespaces need root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("iproute2 is not installed")
+	}
+
+	suffix := fmt.Sprint(os.Getpid())
+	client, proxy, server := "timid-client-"+suffix, "timid-proxy-"+suffix, "timid-server-"+suffix
+	for _, namespace := range []string{client, proxy, server} {
+		ip(t, "netns", "add", namespace)
+		t.Cleanup(func() { exec.Command("ip", "netns", "del", namespace).Run() })
+		ip(t, "-n", namespace, "link", "set", "lo", "up")
+	}
+	ip(t, "link", "add", "veth-client", "netns", client, "type", "veth", "peer", "name", "veth-pc", "netns", proxy)
+	ip(t, "link", "add", "veth-server", "netns", server, "type", "veth", "peer", "name", "veth-ps", "netns", proxy)
+	ip(t, "-n", client, "addr", "add", "10.0.1.2/24", "dev", "veth-client")
+	ip(t, "-n", proxy, "addr", "add", "10.0.1.1/24", "dev", "veth-pc")
+	ip(t, "-n", proxy, "addr", "add", "10.0.2.1/24", "dev", "veth-ps")
+	ip(t, "-n", server, "addr", "add", "10.0.2.2/24", "dev", "veth-server")
+	ip(t, "-n", client, "link", "set", "veth-client", "up")
+	ip(t, "-n", proxy, "link", "set", "veth-pc", "up")
+	ip(t, "-n", proxy, "link", "set", "veth-ps", "up")
+	ip(t, "-n", server, "link", "set", "veth-server", "up")
+	ip(t, "-n", client, "route", "add", "default", "via", "10.0.1.1")
+	// The server has to route replies for clients back through the proxy
+	ip(t, "-n", server, "route", "add", "default", "via", "10.0.2.1")
+	// Deliver replies from the server locally so they reach the transparent sockets
+	ip(t, "-n", proxy, "rule", "add", "iif", "veth-ps", "lookup", "100")
+	ip(t, "-n", proxy, "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100")
+
+	var proxyLog strings.Builder
+	proxyHelper := netnsHelper(proxy, "proxy",
+		"TIMID_PORT=2456", "TIMID_TARGET_ADDRESS="+netnsServerAddress, "TIMID_TRANSPARENT=true", "TIMID_LOG_LEVEL=debug")
+	proxyHelper.Stdout, proxyHelper.Stderr = &proxyLog, &proxyLog
+	for _, helper := range []*exec.Cmd{netnsHelper(server, "server"), proxyHelper} {
+		if err := helper.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			helper.Process.Kill()
+			helper.Wait()
+		})
+	}
+
+	reply, err := netnsHelper(client, "client").Output()
+	if err != nil {
+		t.Fatalf("Client failed: %s\n%s", err, proxyLog.String())
+	}
+	if want := "seen from " + netnsClientAddress; string(reply) != want {
+		t.Fatalf("Server replied %q, want %q", reply, want)
+	}
+}
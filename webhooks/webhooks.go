@@ -0,0 +1,174 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/fuglesteg/timid/eventLog"
+	"github.com/fuglesteg/timid/logging"
+)
+
+const (
+	// Deliveries waiting per webhook, events are dropped when it is full
+	queueSize      = 32
+	maxAttempts    = 5
+	initialBackoff = time.Second
+	requestTimeout = 10 * time.Second
+)
+
+var logger = logging.For(logging.Webhooks)
+
+type Webhook struct {
+	Url      string            `json:"url"`
+	Events   []string          `json:"events"`   // Event types to send, all events if empty
+	Template string            `json:"template"` // text/template rendered with the event, the event as JSON if empty
+	Headers  map[string]string `json:"headers"`
+
+	template *template.Template
+	queue    chan eventLog.Event
+}
+
+type Dispatcher struct {
+	webhooks []*Webhook
+	client   *http.Client
+}
+
+var templateFunctions = template.FuncMap{
+	// Quote a value as a JSON string, for use in JSON payload templates
+	"json": func(value any) (string, error) {
+		bytes, err := json.Marshal(value)
+		return string(bytes), err
+	},
+}
+
+// Read webhooks from a JSON file containing a list of webhooks
+func Load(file string) (*Dispatcher, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []*Webhook
+	if err := json.Unmarshal(bytes, &webhooks); err != nil {
+		return nil, fmt.Errorf("Failed to parse webhooks file %s: %w", file, err)
+	}
+	for i, webhook := range webhooks {
+		if webhook.Url == "" {
+			return nil, fmt.Errorf("Webhook %d has no url", i)
+		}
+		if webhook.Template != "" {
+			webhook.template, err = template.New(webhook.Url).Funcs(templateFunctions).Parse(webhook.Template)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid template for webhook %s: %w", webhook.Url, err)
+			}
+		}
+	}
+	return NewDispatcher(webhooks), nil
+}
+
+func NewDispatcher(webhooks []*Webhook) *Dispatcher {
+	return &Dispatcher{
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Deliver published events to the webhooks in the background
+func (dispatcher *Dispatcher) Start() {
+	events, _ := eventLog.Subscribe()
+	for _, webhook := range dispatcher.webhooks {
+		webhook.queue = make(chan eventLog.Event, queueSize)
+		go dispatcher.deliverQueue(webhook)
+	}
+	go func() {
+		for event := range events {
+			for _, webhook := range dispatcher.webhooks {
+				if !webhook.wants(event) {
+					continue
+				}
+				select {
+				case webhook.queue <- event:
+				default:
+					logger.Error("Webhook is not keeping up, dropped event", "webhook", webhook.Url, "event", event.Type)
+				}
+			}
+		}
+	}()
+}
+
+func (webhook *Webhook) wants(event eventLog.Event) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, eventType := range webhook.Events {
+		if eventType == event.Type || eventType == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (webhook *Webhook) payload(event eventLog.Event) ([]byte, error) {
+	if webhook.template == nil {
+		return json.Marshal(event)
+	}
+	var payload bytes.Buffer
+	err := webhook.template.Execute(&payload, event)
+	return payload.Bytes(), err
+}
+
+func (dispatcher *Dispatcher) deliverQueue(webhook *Webhook) {
+	for event := range webhook.queue {
+		payload, err := webhook.payload(event)
+		if err != nil {
+			logger.Error("Failed to render webhook payload", "webhook", webhook.Url, "event", event.Type, logging.Err(err))
+			continue
+		}
+		backoff := initialBackoff
+		for attempt := 1; ; attempt++ {
+			err = dispatcher.send(webhook, payload)
+			if err == nil {
+				logger.Debug("Delivered event to webhook", "webhook", webhook.Url, "event", event.Type)
+				break
+			}
+			if attempt == maxAttempts {
+				logger.Error("Giving up delivering event to webhook", "webhook", webhook.Url, "event", event.Type,
+					"attempts", attempt, logging.Err(err))
+				break
+			}
+			logger.Warn("Delivering event to webhook failed, retrying", "webhook", webhook.Url, "event", event.Type,
+				"backoff", backoff.String(), logging.Err(err))
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (dispatcher *Dispatcher) send(webhook *Webhook, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range webhook.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := dispatcher.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Status %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fuglesteg/timid/eventLog"
+)
+
+// Stand-in for the receiving service, responds with the statuses in order
+// and 200 once they run out, request bodies are sent to the returned channel
+func newStandIn(t *testing.T, statuses ...int) (*httptest.Server, <-chan []byte) {
+	t.Helper()
+	bodies := make(chan []byte, 128)
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mutex.Unlock()
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, bodies
+}
+
+func receive(t *testing.T, bodies <-chan []byte, timeout time.Duration) []byte {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		return body
+	case <-time.After(timeout):
+		t.Fatal("Webhook was not called")
+		return nil
+	}
+}
+
+func expectNothing(t *testing.T, bodies <-chan []byte) {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		t.Fatalf("Unexpected webhook call with %s", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWebhookFiltersEvents(t *testing.T) {
+	server, bodies := newStandIn(t)
+	NewDispatcher([]*Webhook{{Url: server.URL, Events: []string{eventLog.GroupStarted}}}).Start()
+
+	eventLog.Publish(eventLog.Event{Type: eventLog.GroupStopped, Group: "filter"})
+	eventLog.Publish(eventLog.Event{Type: eventLog.GroupStarted, Group: "filter", Message: "Containers started"})
+
+	var event eventLog.Event
+	if err := json.Unmarshal(receive(t, bodies, time.Second), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventLog.GroupStarted || event.Group != "filter" || event.Message != "Containers started" {
+		t.Errorf("Got event %+v, want the group.started event", event)
+	}
+	expectNothing(t, bodies)
+}
+
+func TestWebhookRendersTemplate(t *testing.T) {
+	server, bodies := newStandIn(t)
+	file := filepath.Join(t.TempDir(), "webhooks.json")
+	webhooks, _ := json.Marshal([]map[string]any{{
+		"url":      server.URL,
+		"events":   []string{eventLog.WakeAborted},
+		"template": `{"content": {{json (printf "%s: %s" .Group .Message)}}}`,
+	}})
+	if err := os.WriteFile(file, webhooks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Start()
+
+	eventLog.Publish(eventLog.Event{Type: eventLog.WakeAborted, Group: "template", Message: `Player "one" joined`})
+
+	want := `{"content": "template: Player \"one\" joined"}`
+	if body := string(receive(t, bodies, time.Second)); body != want {
+		t.Errorf("Got body %s, want %s", body, want)
+	}
+}
+
+func TestWebhookRetriesAfterServerError(t *testing.T) {
+	server, bodies := newStandIn(t, http.StatusInternalServerError)
+	NewDispatcher([]*Webhook{{Url: server.URL, Events: []string{eventLog.GroupPaused}}}).Start()
+
+	eventLog.Publish(eventLog.Event{Type: eventLog.GroupPaused, Group: "retry"})
+
+	first := receive(t, bodies, time.Second)
+	retried := receive(t, bodies, initialBackoff+time.Second)
+	if string(first) != string(retried) {
+		t.Errorf("Retry sent %s, first attempt sent %s", retried, first)
+	}
+	expectNothing(t, bodies)
+}
+
+func TestWebhookQueueDropsEventsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		received <- struct{}{}
+	}))
+	defer server.Close()
+	NewDispatcher([]*Webhook{{Url: server.URL, Events: []string{eventLog.Error}}}).Start()
+
+	published := queueSize * 4
+	start := time.Now()
+	for i := 0; i < published; i++ {
+		eventLog.Publish(eventLog.Event{Type: eventLog.Error, Group: "queue"})
+		// Let the dispatcher keep up with the subscription, so events are
+		// dropped by the full webhook queue
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed > time.Duration(published)*time.Millisecond+time.Second {
+		t.Errorf("Publishing %d events took %s with a stuck webhook", published, elapsed)
+	}
+	close(release)
+
+	// The delivery in progress and a full queue
+	want := queueSize + 1
+	for i := 0; i < want; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("Got %d deliveries, want %d", i, want)
+		}
+	}
+	select {
+	case <-received:
+		t.Errorf("Got more than %d deliveries, events were queued beyond the queue size", want)
+	case <-time.After(200 * time.Millisecond):
+	}
+}